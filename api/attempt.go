@@ -0,0 +1,28 @@
+package aurestclientapi
+
+import "context"
+
+type attemptKeyType struct{}
+
+var attemptKey = attemptKeyType{}
+
+// ContextWithAttempt returns a context that carries the number of the current attempt
+// (1 for the first attempt, 2 for the first retry, ...).
+//
+// Set by aurestretry.RetryImpl. Other layers that repeat requests can use it, too.
+func ContextWithAttempt(ctx context.Context, attempt uint8) context.Context {
+	return context.WithValue(ctx, attemptKey, attempt)
+}
+
+// AttemptFromContext returns the number of the current attempt set using ContextWithAttempt.
+//
+// Returns 0 if the context does not carry an attempt number, e.g. because there is no retry on the stack.
+//
+// Layers below the retry, including their metrics callbacks, can use this to find out which attempt they are
+// processing.
+func AttemptFromContext(ctx context.Context) uint8 {
+	if attempt, ok := ctx.Value(attemptKey).(uint8); ok {
+		return attempt
+	}
+	return 0
+}
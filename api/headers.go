@@ -0,0 +1,35 @@
+package aurestclientapi
+
+import (
+	"context"
+	"net/http"
+)
+
+type requestHeadersKeyType struct{}
+
+var requestHeadersKey = requestHeadersKeyType{}
+
+// ContextWithRequestHeader returns a context that instructs the http client at the bottom of the stack
+// to set an additional request header.
+//
+// This allows layers higher up in the stack to send headers, which they otherwise could not do, because
+// they never see the http.Request. Headers set by the RequestManipulatorCallback take precedence.
+func ContextWithRequestHeader(ctx context.Context, name string, value string) context.Context {
+	existing := RequestHeadersFromContext(ctx)
+	combined := make(http.Header, len(existing)+1)
+	for k, v := range existing {
+		combined[k] = v
+	}
+	combined.Set(name, value)
+	return context.WithValue(ctx, requestHeadersKey, combined)
+}
+
+// RequestHeadersFromContext returns the additional request headers added using ContextWithRequestHeader.
+//
+// Never returns nil. Do not modify the result.
+func RequestHeadersFromContext(ctx context.Context) http.Header {
+	if h, ok := ctx.Value(requestHeadersKey).(http.Header); ok {
+		return h
+	}
+	return http.Header{}
+}
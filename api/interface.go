@@ -21,10 +21,17 @@ type ParsedResponse struct {
 
 // CustomRequestBody allows you the greatest amount of control over the request by directly supplying the
 // body io.Reader, the length, and the content type header.
+//
+// Note that a BodyReader can only be read once. If there is a retry on your stack, it will need to send the body
+// again, so it will rewind readers that implement io.Seeker, call GetBody if provided, and otherwise buffer
+// the body in memory (up to a maximum size, see aurestretry.RetryOptions).
 type CustomRequestBody struct {
 	BodyReader  io.Reader // Tip: &bytes.Buffer{} implements io.Reader
 	BodyLength  int
 	ContentType string
+
+	// GetBody optionally returns a fresh reader for the same body contents, so the body can be sent again.
+	GetBody func() (io.Reader, error)
 }
 
 // Client is a utility class representing a http client.
@@ -104,6 +111,8 @@ type CacheResponseConditionCallback func(ctx context.Context, method string, url
 //
 // You must return a unique string that is used as the cache key. If two requests map to the same key, you will get
 // weird behaviour.
+//
+// If your cacheable requests carry a body, use aurestcaching.BodyAwareKeyFunction.
 type CacheKeyFunction func(ctx context.Context, method string, url string, requestBody interface{}) string
 
 // MetricsCallbackFunction allows you to instrument the http client stack with callbacks in a variety of
@@ -113,4 +122,6 @@ type CacheKeyFunction func(ctx context.Context, method string, url string, reque
 //
 // Not all parameters will always be set. For example, the latency is only known at the request logging level,
 // and the request/response body size is only known while that is being processed.
+//
+// If there is a retry on the stack, AttemptFromContext(ctx) tells you which attempt is being processed.
 type MetricsCallbackFunction func(ctx context.Context, method string, url string, status int, err error, latency time.Duration, size int)
@@ -0,0 +1,273 @@
+package aurestadaptivelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// PartitionKeyFunction determines which downstream a request goes to. Each downstream has its own limit.
+type PartitionKeyFunction func(ctx context.Context, method string, requestUrl string, requestBody interface{}) string
+
+// DropConditionCallback decides whether the outcome of a request indicates that the downstream is overloaded.
+type DropConditionCallback func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool
+
+type AdaptiveLimitOptions struct {
+	// InitialLimit is the number of requests allowed in flight to start with, defaults to 20.
+	InitialLimit int
+	// MinLimit defaults to 1.
+	MinLimit int
+	// MaxLimit defaults to 200.
+	MaxLimit int
+
+	// BackoffRatio is multiplied with the limit on each drop, defaults to 0.9.
+	BackoffRatio float64
+
+	// LatencyThreshold, if set, also counts requests that took longer than this as drops.
+	LatencyThreshold time.Duration
+
+	// DropConditionOrNil determines which outcomes count as drops. Defaults to DefaultDropCondition.
+	DropConditionOrNil DropConditionCallback
+
+	// PartitionKeyOrNil determines the downstream of a request. Defaults to PerHost.
+	PartitionKeyOrNil PartitionKeyFunction
+}
+
+// AdaptiveLimitImpl limits concurrent requests per downstream, adapting the limit by additive increase and
+// multiplicative decrease (AIMD).
+//
+// Each successful request while at least half the limit is in use raises the limit by one, each drop
+// multiplies it with BackoffRatio.
+type AdaptiveLimitImpl struct {
+	Wrapped aurestclientapi.Client
+
+	InitialLimit     int
+	MinLimit         int
+	MaxLimit         int
+	BackoffRatio     float64
+	LatencyThreshold time.Duration
+	DropCondition    DropConditionCallback
+	PartitionKey     PartitionKeyFunction
+
+	LimitMetricsCallback    aurestclientapi.MetricsCallbackFunction
+	RejectedMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+
+	mu         sync.Mutex
+	partitions map[string]*partition
+}
+
+type partition struct {
+	limit    int
+	inFlight int
+}
+
+// LimitExceededError is returned without making the request when the current limit for the downstream
+// is reached.
+//
+// It is a non-tripping error, so circuit breakers further up do not count it.
+type LimitExceededError struct {
+	ctx       context.Context
+	Partition string
+	Limit     int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("concurrency limit of %d reached for '%s'", e.Limit, e.Partition)
+}
+
+// implement NonTrippingError
+
+func (e *LimitExceededError) Ctx() context.Context {
+	return e.ctx
+}
+
+func (e *LimitExceededError) IsNonTrippingError() bool {
+	return true
+}
+
+// IsLimitExceeded checks whether err is (or wraps) a *LimitExceededError.
+func IsLimitExceeded(err error) bool {
+	var limitExceededError *LimitExceededError
+	return errors.As(err, &limitExceededError)
+}
+
+// DefaultDropCondition counts errors (except non-tripping errors and cancellation by the caller), 429 and 503
+// responses as drops.
+func DefaultDropCondition(_ context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+	if err != nil {
+		return !aurestnontripping.Is(err) && !errors.Is(err, context.Canceled)
+	}
+	return response != nil && (response.Status == http.StatusTooManyRequests || response.Status == http.StatusServiceUnavailable)
+}
+
+// PerHost is a PartitionKeyFunction that treats each host as a separate downstream.
+func PerHost(_ context.Context, _ string, requestUrl string, _ interface{}) string {
+	parsed, err := url.Parse(requestUrl)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// New builds an adaptive concurrency limiter with default settings, see AdaptiveLimitOptions.
+//
+// Insert this into your stack below the retry.
+func New(wrapped aurestclientapi.Client) aurestclientapi.Client {
+	return NewWithOptions(wrapped, AdaptiveLimitOptions{})
+}
+
+// NewWithOptions builds an adaptive concurrency limiter with more control, see AdaptiveLimitOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts AdaptiveLimitOptions) aurestclientapi.Client {
+	instance := &AdaptiveLimitImpl{
+		Wrapped:                 wrapped,
+		InitialLimit:            20,
+		MinLimit:                1,
+		MaxLimit:                200,
+		BackoffRatio:            0.9,
+		LatencyThreshold:        opts.LatencyThreshold,
+		DropCondition:           DefaultDropCondition,
+		PartitionKey:            PerHost,
+		LimitMetricsCallback:    doNothingMetricsCallback,
+		RejectedMetricsCallback: doNothingMetricsCallback,
+		Now:                     time.Now,
+		partitions:              make(map[string]*partition),
+	}
+	if opts.InitialLimit > 0 {
+		instance.InitialLimit = opts.InitialLimit
+	}
+	if opts.MinLimit > 0 {
+		instance.MinLimit = opts.MinLimit
+	}
+	if opts.MaxLimit > 0 {
+		instance.MaxLimit = opts.MaxLimit
+	}
+	if opts.BackoffRatio > 0 && opts.BackoffRatio < 1 {
+		instance.BackoffRatio = opts.BackoffRatio
+	}
+	if opts.DropConditionOrNil != nil {
+		instance.DropCondition = opts.DropConditionOrNil
+	}
+	if opts.PartitionKeyOrNil != nil {
+		instance.PartitionKey = opts.PartitionKeyOrNil
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// limitMetricsCallback is called whenever the limit of a downstream changes. The new limit is passed as size.
+// rejectedMetricsCallback is called for each request that is rejected.
+//
+// Either of the callbacks may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	limitMetricsCallback aurestclientapi.MetricsCallbackFunction,
+	rejectedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	limitClient, ok := client.(*AdaptiveLimitImpl)
+	if !ok {
+		return
+	}
+
+	if limitMetricsCallback != nil {
+		limitClient.LimitMetricsCallback = limitMetricsCallback
+	}
+	if rejectedMetricsCallback != nil {
+		limitClient.RejectedMetricsCallback = rejectedMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func (c *AdaptiveLimitImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	key := c.PartitionKey(ctx, method, requestUrl, requestBody)
+
+	if err := c.acquire(ctx, key); err != nil {
+		c.RejectedMetricsCallback(ctx, method, requestUrl, 0, err, 0, 0)
+		return err
+	}
+
+	start := c.Now()
+	err := c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	latency := c.Now().Sub(start)
+
+	dropped := c.DropCondition(ctx, response, err) || (c.LatencyThreshold > 0 && latency > c.LatencyThreshold)
+	before, after := c.release(key, dropped)
+	if after != before {
+		status := 0
+		if response != nil {
+			status = response.Status
+		}
+		c.LimitMetricsCallback(ctx, method, requestUrl, status, err, latency, after)
+	}
+	return err
+}
+
+// Limit returns the current limit for a downstream.
+//
+// Returns the InitialLimit for downstreams that have not seen any requests yet.
+func (c *AdaptiveLimitImpl) Limit(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.partitions[key]; ok {
+		return p.limit
+	}
+	return c.InitialLimit
+}
+
+func (c *AdaptiveLimitImpl) acquire(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.partitionFor(key)
+	if p.inFlight >= p.limit {
+		return &LimitExceededError{ctx: ctx, Partition: key, Limit: p.limit}
+	}
+	p.inFlight++
+	return nil
+}
+
+// release finishes a request and adapts the limit, returning the limit before and after.
+func (c *AdaptiveLimitImpl) release(key string, dropped bool) (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.partitionFor(key)
+	before := p.limit
+	if dropped {
+		p.limit = int(float64(p.limit) * c.BackoffRatio)
+		if p.limit < c.MinLimit {
+			p.limit = c.MinLimit
+		}
+	} else if p.inFlight*2 >= p.limit && p.limit < c.MaxLimit {
+		// only grow while the limit is actually being used
+		p.limit++
+	}
+	p.inFlight--
+	return before, p.limit
+}
+
+// partitionFor returns the partition for key, creating it with the initial limit if needed.
+//
+// Partitions are kept, so what was learned about a downstream is not forgotten.
+//
+// Must be called with the mutex held.
+func (c *AdaptiveLimitImpl) partitionFor(key string) *partition {
+	p, ok := c.partitions[key]
+	if !ok {
+		p = &partition{limit: c.InitialLimit}
+		c.partitions[key] = p
+	}
+	return p
+}
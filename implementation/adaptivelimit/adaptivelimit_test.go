@@ -0,0 +1,136 @@
+package aurestadaptivelimit
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func tstMock() aurestclientapi.Client {
+	return aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://a/ok <nil>": {
+				Status: 200,
+			},
+			"GET http://a/busy <nil>": {
+				Status: 503,
+			},
+			"GET http://b/ok <nil>": {
+				Status: 200,
+			},
+		},
+		map[string]error{
+			"GET http://a/err <nil>":         errors.New("some transport error"),
+			"GET http://a/nontripping <nil>": aurestnontripping.New(context.Background(), errors.New("invalid json")),
+		},
+	)
+}
+
+func tstPerform(cut aurestclientapi.Client, requestUrl string) error {
+	return cut.Perform(context.Background(), "GET", requestUrl, nil, &aurestclientapi.ParsedResponse{})
+}
+
+func TestAIMD(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut := NewWithOptions(tstMock(), AdaptiveLimitOptions{
+		InitialLimit: 10,
+		MinLimit:     2,
+		BackoffRatio: 0.5,
+	}).(*AdaptiveLimitImpl)
+	limits := make([]int, 0)
+	Instrument(cut, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, size int) {
+		limits = append(limits, size)
+	}, nil)
+
+	require.NotNil(t, tstPerform(cut, "http://a/err"))
+	require.Nil(t, tstPerform(cut, "http://a/busy"))
+	require.Equal(t, []int{5, 2}, limits)
+
+	// non-tripping errors are not drops
+	require.NotNil(t, tstPerform(cut, "http://a/nontripping"))
+	require.NotNil(t, tstPerform(cut, "http://a/err"))
+	require.Equal(t, []int{5, 2, 3, 2}, limits)
+	require.Equal(t, 2, cut.Limit("a"))
+
+	// a single request at a time uses half of a limit of 2, so it grows to 3 and stays there
+	for i := 0; i < 5; i++ {
+		require.Nil(t, tstPerform(cut, "http://a/ok"))
+	}
+	require.Equal(t, []int{5, 2, 3, 2, 3}, limits)
+
+	// other downstreams are unaffected, and asking for their limit does not track them
+	require.Equal(t, 10, cut.Limit("b"))
+	require.Equal(t, 1, len(cut.partitions))
+}
+
+func TestRejectsOverLimit(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	blocking := &blockingClient{started: make(chan struct{}), release: make(chan struct{})}
+	cut := NewWithOptions(blocking, AdaptiveLimitOptions{
+		InitialLimit: 1,
+	})
+	rejected := 0
+	Instrument(cut, nil, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+		rejected++
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- tstPerform(cut, "http://a/1")
+	}()
+	<-blocking.started
+
+	err := tstPerform(cut, "http://a/2")
+	require.True(t, IsLimitExceeded(err))
+	require.True(t, aurestnontripping.Is(err))
+	require.Equal(t, "concurrency limit of 1 reached for 'a'", err.Error())
+	require.Equal(t, 1, rejected)
+
+	blocking.release <- struct{}{}
+	require.Nil(t, <-done)
+}
+
+func TestLatencyThreshold(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	slow := &slowClient{wrapped: tstMock(), now: &now, latency: 2 * time.Second}
+	cut := NewWithOptions(slow, AdaptiveLimitOptions{
+		InitialLimit:     10,
+		LatencyThreshold: time.Second,
+	}).(*AdaptiveLimitImpl)
+	cut.Now = func() time.Time { return now }
+
+	require.Nil(t, tstPerform(cut, "http://a/ok"))
+	require.Equal(t, 9, cut.Limit("a"))
+}
+
+type blockingClient struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingClient) Perform(_ context.Context, _ string, _ string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	c.started <- struct{}{}
+	<-c.release
+	return nil
+}
+
+type slowClient struct {
+	wrapped aurestclientapi.Client
+	now     *time.Time
+	latency time.Duration
+}
+
+func (c *slowClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	*c.now = c.now.Add(c.latency)
+	return c.wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+}
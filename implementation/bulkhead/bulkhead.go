@@ -0,0 +1,247 @@
+package aurestbulkhead
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// PartitionKeyFunction determines which limit a request counts against. All requests with the same key
+// share MaxConcurrent.
+type PartitionKeyFunction func(ctx context.Context, method string, requestUrl string, requestBody interface{}) string
+
+type BulkheadOptions struct {
+	// MaxConcurrent is the maximum number of requests in flight per partition, defaults to 10.
+	MaxConcurrent int
+
+	// MaxQueued is the number of requests per partition that may wait for a free slot. If 0, requests
+	// are rejected immediately when all slots are taken.
+	MaxQueued int
+	// MaxWait limits how long a request waits in the queue. If 0, it waits until its context is done.
+	MaxWait time.Duration
+
+	// PartitionKeyOrNil determines the partition of a request. If nil, there is one global limit.
+	// See also PerHost.
+	PartitionKeyOrNil PartitionKeyFunction
+}
+
+type BulkheadImpl struct {
+	Wrapped aurestclientapi.Client
+
+	MaxConcurrent int
+	MaxQueued     int
+	MaxWait       time.Duration
+	PartitionKey  PartitionKeyFunction
+
+	QueueTimeMetricsCallback aurestclientapi.MetricsCallbackFunction
+	RejectedMetricsCallback  aurestclientapi.MetricsCallbackFunction
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+
+	mu         sync.Mutex
+	partitions map[string]*partition
+}
+
+type partition struct {
+	slots   chan struct{}
+	users   int // in flight or waiting, the partition is removed when this drops to 0
+	waiting int
+}
+
+// BulkheadFullError is returned without making the request when all slots of the partition are taken,
+// and the request could not be queued, or waited longer than MaxWait.
+//
+// It is a non-tripping error, so circuit breakers further up do not count it.
+type BulkheadFullError struct {
+	ctx          context.Context
+	Partition    string
+	QueueTimeout bool
+}
+
+func (e *BulkheadFullError) Error() string {
+	if e.QueueTimeout {
+		return fmt.Sprintf("bulkhead full for partition '%s', timed out waiting in queue", e.Partition)
+	}
+	return fmt.Sprintf("bulkhead full for partition '%s'", e.Partition)
+}
+
+// implement NonTrippingError
+
+func (e *BulkheadFullError) Ctx() context.Context {
+	return e.ctx
+}
+
+func (e *BulkheadFullError) IsNonTrippingError() bool {
+	return true
+}
+
+// IsBulkheadFull checks whether err is (or wraps) a *BulkheadFullError.
+func IsBulkheadFull(err error) bool {
+	var bulkheadFullError *BulkheadFullError
+	return errors.As(err, &bulkheadFullError)
+}
+
+// PerHost is a PartitionKeyFunction that limits concurrent requests separately for each host.
+func PerHost(_ context.Context, _ string, requestUrl string, _ interface{}) string {
+	parsed, err := url.Parse(requestUrl)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// New builds a bulkhead that allows at most maxConcurrent requests in flight, and rejects any further
+// requests with a BulkheadFullError.
+//
+// Insert this into your stack below the retry.
+func New(wrapped aurestclientapi.Client, maxConcurrent int) aurestclientapi.Client {
+	return NewWithOptions(wrapped, BulkheadOptions{
+		MaxConcurrent: maxConcurrent,
+	})
+}
+
+// NewWithOptions builds a bulkhead with more control, see BulkheadOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts BulkheadOptions) aurestclientapi.Client {
+	instance := &BulkheadImpl{
+		Wrapped:                  wrapped,
+		MaxConcurrent:            10,
+		MaxQueued:                opts.MaxQueued,
+		MaxWait:                  opts.MaxWait,
+		PartitionKey:             globalPartition,
+		QueueTimeMetricsCallback: doNothingMetricsCallback,
+		RejectedMetricsCallback:  doNothingMetricsCallback,
+		Now:                      time.Now,
+		partitions:               make(map[string]*partition),
+	}
+	if opts.MaxConcurrent > 0 {
+		instance.MaxConcurrent = opts.MaxConcurrent
+	}
+	if opts.PartitionKeyOrNil != nil {
+		instance.PartitionKey = opts.PartitionKeyOrNil
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// queueTimeMetricsCallback is called for each request that obtains a slot, with the time spent waiting as latency.
+// rejectedMetricsCallback is called for each request that is rejected.
+//
+// Either of the callbacks may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	queueTimeMetricsCallback aurestclientapi.MetricsCallbackFunction,
+	rejectedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	bulkheadClient, ok := client.(*BulkheadImpl)
+	if !ok {
+		return
+	}
+
+	if queueTimeMetricsCallback != nil {
+		bulkheadClient.QueueTimeMetricsCallback = queueTimeMetricsCallback
+	}
+	if rejectedMetricsCallback != nil {
+		bulkheadClient.RejectedMetricsCallback = rejectedMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func globalPartition(_ context.Context, _ string, _ string, _ interface{}) string {
+	return ""
+}
+
+func (c *BulkheadImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	key := c.PartitionKey(ctx, method, requestUrl, requestBody)
+	p := c.join(key)
+	defer c.leave(key, p)
+
+	start := c.Now()
+	if err := c.acquire(ctx, key, p); err != nil {
+		if IsBulkheadFull(err) {
+			c.RejectedMetricsCallback(ctx, method, requestUrl, 0, err, c.Now().Sub(start), 0)
+		}
+		return err
+	}
+	defer func() { <-p.slots }()
+	c.QueueTimeMetricsCallback(ctx, method, requestUrl, 0, nil, c.Now().Sub(start), 0)
+
+	return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+}
+
+// InFlight returns the number of requests currently in flight for a partition.
+func (c *BulkheadImpl) InFlight(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.partitions[key]; ok {
+		return len(p.slots)
+	}
+	return 0
+}
+
+func (c *BulkheadImpl) acquire(ctx context.Context, key string, p *partition) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	c.mu.Lock()
+	if p.waiting >= c.MaxQueued {
+		c.mu.Unlock()
+		return &BulkheadFullError{ctx: ctx, Partition: key}
+	}
+	p.waiting++
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		p.waiting--
+		c.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if c.MaxWait > 0 {
+		timer := time.NewTimer(c.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return &BulkheadFullError{ctx: ctx, Partition: key, QueueTimeout: true}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *BulkheadImpl) join(key string) *partition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.partitions[key]
+	if !ok {
+		p = &partition{slots: make(chan struct{}, c.MaxConcurrent)}
+		c.partitions[key] = p
+	}
+	p.users++
+	return p
+}
+
+func (c *BulkheadImpl) leave(key string, p *partition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.users--
+	if p.users == 0 {
+		delete(c.partitions, key)
+	}
+}
@@ -0,0 +1,160 @@
+package aurestbulkhead
+
+import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type blockingClient struct {
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingClient() *blockingClient {
+	return &blockingClient{
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (c *blockingClient) Perform(ctx context.Context, _ string, requestUrl string, _ interface{}, response *aurestclientapi.ParsedResponse) error {
+	c.started <- requestUrl
+	<-c.release
+	response.Status = 200
+	return nil
+}
+
+func tstPerformAsync(cut aurestclientapi.Client, ctx context.Context, requestUrl string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cut.Perform(ctx, "GET", requestUrl, nil, &aurestclientapi.ParsedResponse{})
+	}()
+	return done
+}
+
+func TestRejectsWhenFull(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := newBlockingClient()
+	cut := New(mock, 2)
+	rejected := 0
+	Instrument(cut, nil, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+		rejected++
+	})
+
+	first := tstPerformAsync(cut, context.Background(), "http://a/1")
+	second := tstPerformAsync(cut, context.Background(), "http://b/2")
+	<-mock.started
+	<-mock.started
+	require.Equal(t, 2, cut.(*BulkheadImpl).InFlight(""))
+
+	err := cut.Perform(context.Background(), "GET", "http://a/3", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, IsBulkheadFull(err))
+	require.True(t, aurestnontripping.Is(err))
+	require.Equal(t, "bulkhead full for partition ''", err.Error())
+	require.Equal(t, 1, rejected)
+
+	mock.release <- struct{}{}
+	mock.release <- struct{}{}
+	require.Nil(t, <-first)
+	require.Nil(t, <-second)
+
+	// partitions are not retained once idle
+	require.Equal(t, 0, len(cut.(*BulkheadImpl).partitions))
+}
+
+func TestPerHost(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := newBlockingClient()
+	cut := NewWithOptions(mock, BulkheadOptions{
+		MaxConcurrent:     1,
+		PartitionKeyOrNil: PerHost,
+	})
+
+	first := tstPerformAsync(cut, context.Background(), "http://a/1")
+	second := tstPerformAsync(cut, context.Background(), "http://b/2")
+	<-mock.started
+	<-mock.started
+
+	err := cut.Perform(context.Background(), "GET", "http://a/3", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, IsBulkheadFull(err))
+	require.Equal(t, "bulkhead full for partition 'a'", err.Error())
+
+	mock.release <- struct{}{}
+	mock.release <- struct{}{}
+	require.Nil(t, <-first)
+	require.Nil(t, <-second)
+}
+
+func TestQueue(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := newBlockingClient()
+	cut := NewWithOptions(mock, BulkheadOptions{
+		MaxConcurrent: 1,
+		MaxQueued:     1,
+	})
+	queueTimes := make([]time.Duration, 0)
+	var mu sync.Mutex
+	Instrument(cut, func(_ context.Context, _ string, _ string, _ int, _ error, latency time.Duration, _ int) {
+		mu.Lock()
+		defer mu.Unlock()
+		queueTimes = append(queueTimes, latency)
+	}, nil)
+
+	first := tstPerformAsync(cut, context.Background(), "http://a/1")
+	<-mock.started
+	queued := tstPerformAsync(cut, context.Background(), "http://a/2")
+	require.Eventually(t, func() bool {
+		cut.(*BulkheadImpl).mu.Lock()
+		defer cut.(*BulkheadImpl).mu.Unlock()
+		return cut.(*BulkheadImpl).partitions[""].waiting == 1
+	}, time.Second, time.Millisecond)
+
+	// the queue is full, too
+	err := cut.Perform(context.Background(), "GET", "http://a/3", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, IsBulkheadFull(err))
+
+	mock.release <- struct{}{}
+	require.Nil(t, <-first)
+	require.Equal(t, "http://a/2", <-mock.started)
+	mock.release <- struct{}{}
+	require.Nil(t, <-queued)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, len(queueTimes))
+}
+
+func TestQueueTimeout(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := newBlockingClient()
+	cut := NewWithOptions(mock, BulkheadOptions{
+		MaxConcurrent: 1,
+		MaxQueued:     5,
+		MaxWait:       10 * time.Millisecond,
+	})
+
+	first := tstPerformAsync(cut, context.Background(), "http://a/1")
+	<-mock.started
+
+	err := cut.Perform(context.Background(), "GET", "http://a/2", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, IsBulkheadFull(err))
+	require.True(t, err.(*BulkheadFullError).QueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = cut.Perform(ctx, "GET", "http://a/3", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, context.Canceled, err)
+
+	mock.release <- struct{}{}
+	require.Nil(t, <-first)
+}
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestdetachedcontext "github.com/StephanHCB/go-autumn-restclient/implementation/internal/detachedcontext"
+	aurestresponsecopy "github.com/StephanHCB/go-autumn-restclient/implementation/internal/responsecopy"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
 	"github.com/tidwall/tinylru"
+	"sync"
 	"time"
 )
 
@@ -23,8 +27,42 @@ type CachingImpl struct {
 	CacheMissMetricsCallback    aurestclientapi.MetricsCallbackFunction
 	CacheInvalidMetricsCallback aurestclientapi.MetricsCallbackFunction
 
+	// RefreshAheadFraction enables refresh-ahead if set to a value between 0 and 1 (exclusive).
+	//
+	// When a cache entry is hit after this fraction of RetentionTime has passed, the cached response is returned,
+	// and the entry is refreshed in the background, so callers rarely see a miss for frequently used entries.
+	RefreshAheadFraction float64
+	// RefreshAheadTimeout limits the duration of a background refresh. 0 means no timeout.
+	RefreshAheadTimeout time.Duration
+
+	// Redactor masks secrets in urls in log messages, errors and Entries(). nil uses aurestredaction.Default().
+	Redactor *aurestredaction.Redactor
+
 	// Now is exposed so tests can fixate the time by overwriting this field
 	Now func() time.Time
+
+	refreshMutex    sync.Mutex
+	refreshInFlight map[string]struct{}
+	refreshWg       sync.WaitGroup
+
+	statsMutex sync.Mutex
+	counters   cacheCounters
+}
+
+type CachingOptions struct {
+	// CacheKeyFunctionOrNil overrides the default key function if set.
+	CacheKeyFunctionOrNil aurestclientapi.CacheKeyFunction
+
+	RetentionTime time.Duration
+	CacheSize     int
+
+	// RefreshAheadFraction enables refresh-ahead, see CachingImpl.RefreshAheadFraction.
+	RefreshAheadFraction float64
+	// RefreshAheadTimeout limits the duration of a background refresh. 0 means no timeout.
+	RefreshAheadTimeout time.Duration
+
+	// RedactorOrNil masks secrets in urls in log messages, errors and Entries(). Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
 }
 
 type CacheEntry struct {
@@ -63,6 +101,23 @@ func New(
 	}
 }
 
+// NewWithOptions builds a caching client, allowing access to the extended features through CachingOptions.
+func NewWithOptions(
+	wrapped aurestclientapi.Client,
+	useCacheCondition aurestclientapi.CacheConditionCallback,
+	storeResponseInCacheCondition aurestclientapi.CacheResponseConditionCallback,
+	opts CachingOptions,
+) aurestclientapi.Client {
+	instance := New(wrapped, useCacheCondition, storeResponseInCacheCondition, opts.CacheKeyFunctionOrNil,
+		opts.RetentionTime, opts.CacheSize).(*CachingImpl)
+	if opts.RefreshAheadFraction > 0 && opts.RefreshAheadFraction < 1 {
+		instance.RefreshAheadFraction = opts.RefreshAheadFraction
+	}
+	instance.RefreshAheadTimeout = opts.RefreshAheadTimeout
+	instance.Redactor = opts.RedactorOrNil
+	return instance
+}
+
 // Instrument adds instrumentation to a http client.
 //
 // Either of the callbacks may be nil.
@@ -99,59 +154,152 @@ func defaultKeyFunction(_ context.Context, method string, requestUrl string, _ i
 func (c *CachingImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
 	canCache := c.UseCacheCondition(ctx, method, requestUrl, requestBody)
 	if canCache {
+		directives := cacheDirectivesFromContext(ctx)
 		key := c.CacheKeyFunction(ctx, method, requestUrl, requestBody)
-		cachedResponseRaw, ok := c.Cache.Get(key)
+		if !directives.forceRefresh {
+			if c.lookup(ctx, key, method, requestUrl, requestBody, response, directives) {
+				return nil
+			}
+		}
+		if directives.onlyIfCached {
+			return &CacheMissError{ctx: ctx, method: method, requestUrl: c.redactUrl(requestUrl)}
+		}
+		err := c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+		if err == nil && !directives.noStore {
+			c.storeIfConditionMet(ctx, key, method, requestUrl, requestBody, response)
+		}
+		return err
+	} else {
+		return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	}
+}
+
+// lookup tries to fill response from the cache, returning true on a cache hit.
+//
+// No refresh-ahead is started if the directives forbid reaching out to the downstream or storing the result.
+func (c *CachingImpl) lookup(ctx context.Context, key string, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse, directives cacheDirectives) bool {
+	cachedResponseRaw, ok := c.Cache.Get(key)
+	if ok {
+		cachedResponse, ok := cachedResponseRaw.(CacheEntry)
 		if ok {
-			cachedResponse, ok := cachedResponseRaw.(CacheEntry)
-			if ok {
-				age := c.Now().Sub(cachedResponse.Recorded)
-				if age < c.RetentionTime {
-					err := json.Unmarshal(cachedResponse.ResponseBodyJson, response.Body)
-					err2 := json.Unmarshal(cachedResponse.ResponseHeaderJson, &response.Header)
-					response.Status = cachedResponse.ResponseStatus
-					response.Time = cachedResponse.Recorded
-					if err == nil && err2 == nil {
-						// cache successfully used
-						c.CacheHitMetricsCallback(ctx, method, requestUrl, response.Status, nil, 0, len(cachedResponse.ResponseBodyJson))
-						aulogging.Logger.Ctx(ctx).Info().Printf("downstream %s %s -> %d cached %d seconds ago", method, requestUrl, response.Status, age.Milliseconds()/1000)
-						return nil
-					} else {
-						// invalid cache entry -- delete
-						c.CacheInvalidMetricsCallback(ctx, method, requestUrl, 0, err, 0, 0)
-						aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("downstream %s %s -> %d cache FAIL, see error -- deleting cache entry", method, requestUrl, response.Status)
-						c.Cache.Delete(key)
+			age := c.Now().Sub(cachedResponse.Recorded)
+			if age < c.RetentionTime {
+				err := json.Unmarshal(cachedResponse.ResponseBodyJson, response.Body)
+				err2 := json.Unmarshal(cachedResponse.ResponseHeaderJson, &response.Header)
+				response.Status = cachedResponse.ResponseStatus
+				response.Time = cachedResponse.Recorded
+				if err == nil && err2 == nil {
+					// cache successfully used
+					c.countHit()
+					c.CacheHitMetricsCallback(ctx, method, requestUrl, response.Status, nil, 0, len(cachedResponse.ResponseBodyJson))
+					aulogging.Logger.Ctx(ctx).Info().Printf("downstream %s %s -> %d cached %d seconds ago", method, c.redactUrl(requestUrl), response.Status, age.Milliseconds()/1000)
+					if !directives.noStore && !directives.onlyIfCached && c.needsRefreshAhead(age) {
+						c.refreshAhead(ctx, key, method, requestUrl, requestBody, response.Body)
 					}
+					return true
 				} else {
-					// cache miss - entry there but too old
-					c.CacheMissMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
+					// invalid cache entry -- delete
+					c.countInvalid()
+					c.CacheInvalidMetricsCallback(ctx, method, requestUrl, 0, err, 0, 0)
+					aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("downstream %s %s -> %d cache FAIL, see error -- deleting cache entry", method, c.redactUrl(requestUrl), response.Status)
 					c.Cache.Delete(key)
 				}
 			} else {
-				// invalid cache entry -- delete
-				c.CacheInvalidMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
-				aulogging.Logger.Ctx(ctx).Error().Printf("downstream %s %s -> %d cache FAIL, invalid type -- deleting cache entry", method, requestUrl, response.Status)
+				// cache miss - entry there but too old
+				c.countMiss()
+				c.CacheMissMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
 				c.Cache.Delete(key)
 			}
 		} else {
-			// cache miss
-			c.CacheMissMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
+			// invalid cache entry -- delete
+			c.countInvalid()
+			c.CacheInvalidMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
+			aulogging.Logger.Ctx(ctx).Error().Printf("downstream %s %s -> %d cache FAIL, invalid type -- deleting cache entry", method, c.redactUrl(requestUrl), response.Status)
+			c.Cache.Delete(key)
 		}
-		err := c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
-		if err == nil && canCache && c.StoreResponseInCacheCondition(ctx, method, requestUrl, requestBody, response) {
-			bodyJson, err := json.Marshal(response.Body)
-			headerJson, err2 := json.Marshal(&response.Header)
-			status := response.Status
-			if err == nil && err2 == nil {
-				_, _ = c.Cache.Set(key, CacheEntry{
-					Recorded:           response.Time,
-					ResponseBodyJson:   bodyJson,
-					ResponseHeaderJson: headerJson,
-					ResponseStatus:     status,
-				})
-			}
-		}
-		return err
 	} else {
-		return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+		// cache miss
+		c.countMiss()
+		c.CacheMissMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
+	}
+	return false
+}
+
+func (c *CachingImpl) storeIfConditionMet(ctx context.Context, key string, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) {
+	if c.StoreResponseInCacheCondition(ctx, method, requestUrl, requestBody, response) {
+		bodyJson, err := json.Marshal(response.Body)
+		headerJson, err2 := json.Marshal(&response.Header)
+		status := response.Status
+		if err == nil && err2 == nil {
+			c.set(key, CacheEntry{
+				Recorded:           response.Time,
+				ResponseBodyJson:   bodyJson,
+				ResponseHeaderJson: headerJson,
+				ResponseStatus:     status,
+			})
+		}
+	}
+}
+
+func (c *CachingImpl) redactUrl(requestUrl string) string {
+	return aurestredaction.Use(c.Redactor).Url(requestUrl)
+}
+
+func (c *CachingImpl) needsRefreshAhead(age time.Duration) bool {
+	if c.RefreshAheadFraction <= 0 || c.RefreshAheadFraction >= 1 {
+		return false
+	}
+	return float64(age) >= c.RefreshAheadFraction*float64(c.RetentionTime)
+}
+
+// WaitForRefreshes blocks until all background refresh-ahead requests that are currently in flight have completed.
+//
+// Mostly useful for writing deterministic tests.
+func (c *CachingImpl) WaitForRefreshes() {
+	c.refreshWg.Wait()
+}
+
+// refreshAhead starts a background refresh of the cache entry for key, unless one is already in flight.
+//
+// The refresh uses a context that keeps the values of ctx (for logging, tracing etc.), but is detached
+// from its cancellation, because the original request will usually have completed long before the refresh does.
+func (c *CachingImpl) refreshAhead(ctx context.Context, key string, method string, requestUrl string, requestBody interface{}, bodyTemplate interface{}) {
+	c.refreshMutex.Lock()
+	if c.refreshInFlight == nil {
+		c.refreshInFlight = make(map[string]struct{})
+	}
+	if _, ok := c.refreshInFlight[key]; ok {
+		c.refreshMutex.Unlock()
+		return
+	}
+	c.refreshInFlight[key] = struct{}{}
+	c.refreshMutex.Unlock()
+
+	refreshCtx := aurestdetachedcontext.Detach(ctx)
+	var cancel context.CancelFunc = func() {}
+	if c.RefreshAheadTimeout > 0 {
+		refreshCtx, cancel = context.WithTimeout(refreshCtx, c.RefreshAheadTimeout)
 	}
+
+	c.refreshWg.Add(1)
+	go func() {
+		defer c.refreshWg.Done()
+		defer cancel()
+		defer func() {
+			c.refreshMutex.Lock()
+			delete(c.refreshInFlight, key)
+			c.refreshMutex.Unlock()
+		}()
+
+		response := &aurestclientapi.ParsedResponse{
+			Body: aurestresponsecopy.NewBodyLike(bodyTemplate),
+		}
+		err := c.Wrapped.Perform(refreshCtx, method, requestUrl, requestBody, response)
+		if err != nil {
+			aulogging.Logger.Ctx(refreshCtx).Warn().WithErr(aurestredaction.Use(c.Redactor).Error(err, requestUrl)).Printf("downstream %s %s -> %d cache refresh-ahead FAILED, keeping cache entry", method, c.redactUrl(requestUrl), response.Status)
+			return
+		}
+		c.storeIfConditionMet(refreshCtx, key, method, requestUrl, requestBody, response)
+		aulogging.Logger.Ctx(refreshCtx).Debug().Printf("downstream %s %s -> %d cache refreshed ahead", method, c.redactUrl(requestUrl), response.Status)
+	}()
 }
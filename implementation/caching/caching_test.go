@@ -1,15 +1,21 @@
 package aurestcaching
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
 	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestdetachedcontext "github.com/StephanHCB/go-autumn-restclient/implementation/internal/detachedcontext"
 	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
 	"github.com/go-http-utils/headers"
 	"github.com/stretchr/testify/require"
+	"io"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -227,3 +233,391 @@ func TestCacheDeletionCorruptJson(t *testing.T) {
 	// and the entry should have been removed from the cache (but we can't test this because it will just
 	// have been added again)
 }
+
+func TestRefreshAhead(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc := func() time.Time {
+		return now
+	}
+
+	mockClient := tstMock()
+	mockClient.(*aurestcapture.RequestCaptureImpl).Wrapped.(*aurestmock.MockImpl).Now = nowFunc
+	cut := NewWithOptions(mockClient,
+		func(ctx context.Context, method string, url string, requestBody interface{}) bool {
+			return strings.Contains(url, "cache-me")
+		},
+		func(ctx context.Context, method string, url string, requestBody interface{}, response *aurestclientapi.ParsedResponse) bool {
+			return strings.Contains(url, "cache-me") && response.Status == 200
+		},
+		CachingOptions{
+			RetentionTime:        100 * time.Second,
+			CacheSize:            10,
+			RefreshAheadFraction: 0.5,
+		},
+	)
+	cachingImpl := cut.(*CachingImpl)
+	cachingImpl.Now = nowFunc
+
+	aurestcapture.ResetRecording(mockClient)
+	response := &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err := cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	require.Nil(t, err)
+	require.Equal(t, []string{"GET http://cache-me <nil>"}, aurestcapture.GetRecording(mockClient))
+
+	// young entry - plain cache hit, no refresh
+	now = now.Add(40 * time.Second)
+	aurestcapture.ResetRecording(mockClient)
+	response = &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err = cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	cachingImpl.WaitForRefreshes()
+	require.Nil(t, err)
+	require.Equal(t, "&[first second]", fmt.Sprintf("%v", response.Body))
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mockClient))
+
+	// older than half the retention time - served from cache, but refreshed in the background
+	now = now.Add(20 * time.Second)
+	aurestcapture.ResetRecording(mockClient)
+	response = &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err = cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	cachingImpl.WaitForRefreshes()
+	require.Nil(t, err)
+	require.Equal(t, "&[first second]", fmt.Sprintf("%v", response.Body))
+	require.Equal(t, time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC), response.Time)
+	require.Equal(t, []string{"GET http://cache-me <nil>"}, aurestcapture.GetRecording(mockClient))
+
+	// entry now has the refreshed time, so it is still valid after the original retention time has passed
+	now = now.Add(40 * time.Second)
+	aurestcapture.ResetRecording(mockClient)
+	response = &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err = cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	cachingImpl.WaitForRefreshes()
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2022, 1, 1, 12, 1, 0, 0, time.UTC), response.Time)
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mockClient))
+}
+
+func TestRefreshAheadSkippedForOnlyIfCached(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	nowFunc := func() time.Time {
+		return now
+	}
+
+	mockClient := tstMock()
+	cut := NewWithOptions(mockClient,
+		func(ctx context.Context, method string, url string, requestBody interface{}) bool {
+			return strings.Contains(url, "cache-me")
+		},
+		func(ctx context.Context, method string, url string, requestBody interface{}, response *aurestclientapi.ParsedResponse) bool {
+			return strings.Contains(url, "cache-me") && response.Status == 200
+		},
+		CachingOptions{
+			RetentionTime:        100 * time.Second,
+			CacheSize:            10,
+			RefreshAheadFraction: 0.5,
+		},
+	)
+	cachingImpl := cut.(*CachingImpl)
+	cachingImpl.Now = nowFunc
+
+	response := &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err := cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	require.Nil(t, err)
+
+	// older than half the retention time, but only-if-cached must never reach the downstream
+	now = now.Add(60 * time.Second)
+	aurestcapture.ResetRecording(mockClient)
+	response = &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err = cut.Perform(WithOnlyIfCached(context.Background()), "GET", "http://cache-me", nil, response)
+	cachingImpl.WaitForRefreshes()
+	require.Nil(t, err)
+	require.Equal(t, "&[first second]", fmt.Sprintf("%v", response.Body))
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mockClient))
+}
+
+func TestRefreshAheadDetachedContext(t *testing.T) {
+	type ctxKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	cancel()
+
+	detached := aurestdetachedcontext.Detach(ctx)
+	require.Nil(t, detached.Err())
+	require.Equal(t, "value", detached.Value(ctxKey{}))
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := tstCut(mock)
+
+	response := &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err := cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	require.Nil(t, err)
+
+	snapshot := &bytes.Buffer{}
+	err = cut.(*CachingImpl).Snapshot(snapshot)
+	require.Nil(t, err)
+
+	// a cold cache restored from the snapshot should not need to make the request
+	restored := tstCut(mock)
+	err = restored.(*CachingImpl).Restore(snapshot)
+	require.Nil(t, err)
+
+	aurestcapture.ResetRecording(mock)
+	response = &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err = restored.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	require.Nil(t, err)
+	require.Equal(t, "&[first second]", fmt.Sprintf("%v", response.Body))
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mock))
+}
+
+func TestRestoreSkipsExpiredEntries(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := tstCut(mock)
+
+	response := &aurestclientapi.ParsedResponse{
+		Body: &[]string{},
+	}
+	err := cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+	require.Nil(t, err)
+
+	snapshot := &bytes.Buffer{}
+	err = cut.(*CachingImpl).Snapshot(snapshot)
+	require.Nil(t, err)
+
+	restored := tstCut(mock)
+	restored.(*CachingImpl).Now = func() time.Time {
+		return time.Now().Add(time.Hour)
+	}
+	err = restored.(*CachingImpl).Restore(snapshot)
+	require.Nil(t, err)
+	require.Equal(t, 0, restored.(*CachingImpl).Cache.Len())
+}
+
+func TestStatsAndEntries(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := tstCut(mock)
+	cachingImpl := cut.(*CachingImpl)
+
+	for i := 0; i < 3; i++ {
+		response := &aurestclientapi.ParsedResponse{
+			Body: &[]string{},
+		}
+		err := cut.Perform(context.Background(), "GET", "http://cache-me", nil, response)
+		require.Nil(t, err)
+	}
+
+	stats := cachingImpl.Stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, uint64(2), stats.Hits)
+	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, uint64(0), stats.Evictions)
+	require.InDelta(t, 0.666, stats.HitRatio, 0.01)
+	require.Equal(t, 1, stats.AgeDistribution.FirstQuarter)
+	require.True(t, stats.Bytes > 0)
+
+	keys := make([]string, 0)
+	cachingImpl.Entries(func(info CacheEntryInfo) bool {
+		keys = append(keys, info.Key)
+		require.Equal(t, CacheEntryValid, info.Status)
+		require.Equal(t, 200, info.ResponseStatus)
+		return true
+	})
+	require.Equal(t, []string{"GET http://cache-me"}, keys)
+}
+
+func TestStatsCountsEvictions(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut := New(aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://cache-me/1 <nil>": {Status: 200},
+			"GET http://cache-me/2 <nil>": {Status: 200},
+		},
+		map[string]error{},
+	),
+		func(ctx context.Context, method string, url string, requestBody interface{}) bool {
+			return true
+		},
+		func(ctx context.Context, method string, url string, requestBody interface{}, response *aurestclientapi.ParsedResponse) bool {
+			return true
+		},
+		nil,
+		time.Minute,
+		1,
+	)
+
+	for _, u := range []string{"http://cache-me/1", "http://cache-me/2"} {
+		err := cut.Perform(context.Background(), "GET", u, nil, &aurestclientapi.ParsedResponse{})
+		require.Nil(t, err)
+	}
+
+	stats := cut.(*CachingImpl).Stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestForceRefresh(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := tstCut(mock)
+
+	err := cut.Perform(context.Background(), "GET", "http://cache-me", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}})
+	require.Nil(t, err)
+
+	// skips the lookup and makes the request
+	aurestcapture.ResetRecording(mock)
+	err = cut.Perform(WithForceRefresh(context.Background()), "GET", "http://cache-me", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"GET http://cache-me <nil>"}, aurestcapture.GetRecording(mock))
+
+	// but the result was stored
+	aurestcapture.ResetRecording(mock)
+	err = cut.Perform(context.Background(), "GET", "http://cache-me", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}})
+	require.Nil(t, err)
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mock))
+}
+
+func TestNoStore(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := tstCut(mock)
+
+	err := cut.Perform(WithNoStore(context.Background()), "GET", "http://cache-me", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}})
+	require.Nil(t, err)
+	require.Equal(t, 0, cut.(*CachingImpl).Cache.Len())
+}
+
+func TestOnlyIfCached(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := tstCut(mock)
+	ctx := WithOnlyIfCached(context.Background())
+
+	aurestcapture.ResetRecording(mock)
+	err := cut.Perform(ctx, "GET", "http://cache-me", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}})
+	require.NotNil(t, err)
+	require.True(t, IsCacheMiss(err))
+	require.True(t, aurestnontripping.Is(err))
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mock))
+
+	err = cut.Perform(context.Background(), "GET", "http://cache-me", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}})
+	require.Nil(t, err)
+
+	response := &aurestclientapi.ParsedResponse{Body: &[]string{}}
+	err = cut.Perform(ctx, "GET", "http://cache-me", nil, response)
+	require.Nil(t, err)
+	require.Equal(t, "&[first second]", fmt.Sprintf("%v", response.Body))
+
+	// requests that are not cacheable are unaffected
+	aurestcapture.ResetRecording(mock)
+	err = cut.Perform(ctx, "GET", "http://ok", nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"GET http://ok <nil>"}, aurestcapture.GetRecording(mock))
+}
+
+func TestBodyAwareKeyFunction(t *testing.T) {
+	ctx := context.Background()
+
+	require.Equal(t, "GET http://cache-me?a=1&b=2", BodyAwareKeyFunction(ctx, "GET", "http://cache-me?b=2&a=1", nil))
+
+	jsonKey1 := BodyAwareKeyFunction(ctx, "POST", "http://search", map[string]interface{}{"b": 2, "a": "x"})
+	jsonKey2 := BodyAwareKeyFunction(ctx, "POST", "http://search", `{"a":"x", "b":2}`)
+	jsonKey3 := BodyAwareKeyFunction(ctx, "POST", "http://search", `{"a":"y", "b":2}`)
+	require.Equal(t, jsonKey1, jsonKey2)
+	require.NotEqual(t, jsonKey1, jsonKey3)
+
+	formKey1 := BodyAwareKeyFunction(ctx, "POST", "http://search", url.Values{"b": {"2"}, "a": {"1"}})
+	formKey2 := BodyAwareKeyFunction(ctx, "POST", "http://search", url.Values{"a": {"1"}, "b": {"2"}})
+	require.Equal(t, formKey1, formKey2)
+}
+
+func TestBodyAwareKeyFunctionRestoresCustomBody(t *testing.T) {
+	ctx := context.Background()
+
+	buffer := bytes.NewBufferString(`{"b":2,"a":"x"}`)
+	bufferKey := BodyAwareKeyFunction(ctx, "POST", "http://search", aurestclientapi.CustomRequestBody{
+		BodyReader:  buffer,
+		BodyLength:  buffer.Len(),
+		ContentType: aurestclientapi.ContentTypeApplicationJson,
+	})
+	require.Equal(t, `{"b":2,"a":"x"}`, buffer.String())
+
+	reader := strings.NewReader(`{"a":"x","b":2}`)
+	readerKey := BodyAwareKeyFunction(ctx, "POST", "http://search", aurestclientapi.CustomRequestBody{
+		BodyReader:  reader,
+		BodyLength:  int(reader.Size()),
+		ContentType: aurestclientapi.ContentTypeApplicationJson,
+	})
+	require.Equal(t, bufferKey, readerKey)
+	remaining, _ := io.ReadAll(reader)
+	require.Equal(t, `{"a":"x","b":2}`, string(remaining))
+}
+
+func TestRedactedDebugOutput(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut := NewWithOptions(aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://cache-me?token=s3cr3t <nil>": {Status: 200},
+		},
+		map[string]error{},
+	),
+		func(ctx context.Context, method string, url string, requestBody interface{}) bool {
+			return true
+		},
+		func(ctx context.Context, method string, url string, requestBody interface{}, response *aurestclientapi.ParsedResponse) bool {
+			return true
+		},
+		CachingOptions{
+			RetentionTime: time.Minute,
+			CacheSize:     10,
+			RedactorOrNil: aurestredaction.New(aurestredaction.RedactionOptions{
+				QueryParameters: []string{"token"},
+			}),
+		},
+	)
+	cachingImpl := cut.(*CachingImpl)
+
+	err := cut.Perform(WithOnlyIfCached(context.Background()), "GET", "http://cache-me?token=s3cr3t", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, IsCacheMiss(err))
+	require.Equal(t, "GET http://cache-me?token=*** not found in cache and request was only-if-cached", err.Error())
+
+	require.Nil(t, cut.Perform(context.Background(), "GET", "http://cache-me?token=s3cr3t", nil, &aurestclientapi.ParsedResponse{}))
+	keys := make([]string, 0)
+	cachingImpl.Entries(func(info CacheEntryInfo) bool {
+		keys = append(keys, info.Key)
+		return true
+	})
+	require.Equal(t, []string{"GET http://cache-me?token=***"}, keys)
+
+	// the real key is still used for lookups
+	require.Nil(t, cut.Perform(WithOnlyIfCached(context.Background()), "GET", "http://cache-me?token=s3cr3t", nil, &aurestclientapi.ParsedResponse{Body: &[]string{}}))
+}
@@ -0,0 +1,89 @@
+package aurestcaching
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type cacheDirectivesKeyType struct{}
+
+var cacheDirectivesKey = cacheDirectivesKeyType{}
+
+type cacheDirectives struct {
+	forceRefresh bool
+	noStore      bool
+	onlyIfCached bool
+}
+
+func cacheDirectivesFromContext(ctx context.Context) cacheDirectives {
+	if directives, ok := ctx.Value(cacheDirectivesKey).(cacheDirectives); ok {
+		return directives
+	}
+	return cacheDirectives{}
+}
+
+func withDirective(ctx context.Context, modify func(d *cacheDirectives)) context.Context {
+	directives := cacheDirectivesFromContext(ctx)
+	modify(&directives)
+	return context.WithValue(ctx, cacheDirectivesKey, directives)
+}
+
+// WithForceRefresh returns a context that makes CachingImpl skip the cache lookup, but still store the result.
+//
+// Corresponds to the Cache-Control: no-cache request directive. Use this when a user explicitly asks for fresh data.
+func WithForceRefresh(ctx context.Context) context.Context {
+	return withDirective(ctx, func(d *cacheDirectives) {
+		d.forceRefresh = true
+	})
+}
+
+// WithNoStore returns a context that makes CachingImpl not store the result of the request.
+//
+// Corresponds to the Cache-Control: no-store request directive. Cache lookups still happen.
+func WithNoStore(ctx context.Context) context.Context {
+	return withDirective(ctx, func(d *cacheDirectives) {
+		d.noStore = true
+	})
+}
+
+// WithOnlyIfCached returns a context that makes CachingImpl return a *CacheMissError instead of making the
+// request if there is no valid cache entry.
+//
+// Corresponds to the Cache-Control: only-if-cached request directive. Useful for offline tests.
+//
+// Only applies to requests for which the CacheConditionCallback returns true, all others are passed through as usual.
+func WithOnlyIfCached(ctx context.Context) context.Context {
+	return withDirective(ctx, func(d *cacheDirectives) {
+		d.onlyIfCached = true
+	})
+}
+
+// CacheMissError is returned by CachingImpl when a request made with WithOnlyIfCached cannot be served from the cache.
+//
+// It is a non-tripping error, because no downstream request was made.
+type CacheMissError struct {
+	ctx        context.Context
+	method     string
+	requestUrl string
+}
+
+func (e *CacheMissError) Error() string {
+	return fmt.Sprintf("%s %s not found in cache and request was only-if-cached", e.method, e.requestUrl)
+}
+
+// implement NonTrippingError
+
+func (e *CacheMissError) Ctx() context.Context {
+	return e.ctx
+}
+
+func (e *CacheMissError) IsNonTrippingError() bool {
+	return true
+}
+
+// IsCacheMiss checks whether err is (or wraps) a *CacheMissError.
+func IsCacheMiss(err error) bool {
+	var cacheMissError *CacheMissError
+	return errors.As(err, &cacheMissError)
+}
@@ -0,0 +1,108 @@
+package aurestcaching
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"io"
+	"net/url"
+)
+
+// BodyAwareKeyFunction is a CacheKeyFunction that, unlike the default key function, includes the request body.
+//
+// Use it for safe requests that carry a body, such as search endpoints that take a POST with a json body.
+//
+// The key consists of the method, the url with the query parameters sorted, and a sha256 hash over a canonical
+// form of the request body:
+//   - json bodies (structs, maps, json strings) are hashed with sorted keys
+//   - url.Values are hashed in their sorted encoding
+//   - a CustomRequestBody is read and then restored, which only works if the BodyReader is a *bytes.Buffer
+//     or implements io.Seeker. Any other reader cannot be restored, so it is not read, and the key will be
+//     unique to the reader instance, which means the response is never found in the cache.
+func BodyAwareKeyFunction(_ context.Context, method string, requestUrl string, requestBody interface{}) string {
+	normalizedUrl := normalizeQuery(requestUrl)
+	if requestBody == nil {
+		return fmt.Sprintf("%s %s", method, normalizedUrl)
+	}
+	return fmt.Sprintf("%s %s %s", method, normalizedUrl, hashBody(requestBody))
+}
+
+func normalizeQuery(requestUrl string) string {
+	parsedUrl, err := url.Parse(requestUrl)
+	if err != nil || parsedUrl.RawQuery == "" {
+		return requestUrl
+	}
+	parsedUrl.RawQuery = parsedUrl.Query().Encode()
+	return parsedUrl.String()
+}
+
+func hashBody(requestBody interface{}) string {
+	sum := sha256.Sum256(canonicalBody(requestBody))
+	return hex.EncodeToString(sum[:])
+}
+
+func canonicalBody(requestBody interface{}) []byte {
+	switch body := requestBody.(type) {
+	case aurestclientapi.CustomRequestBody:
+		contents, ok := peekCustomBody(body)
+		if !ok {
+			return []byte(fmt.Sprintf("unrestorable %s %p", body.ContentType, body.BodyReader))
+		}
+		if body.ContentType == aurestclientapi.ContentTypeApplicationJson {
+			return canonicalJson(contents)
+		}
+		return append([]byte(body.ContentType+"\n"), contents...)
+	case url.Values:
+		return []byte(body.Encode())
+	case string:
+		return canonicalJson([]byte(body))
+	default:
+		marshalled, err := json.Marshal(body)
+		if err != nil {
+			return []byte(fmt.Sprintf("%#v", body))
+		}
+		return canonicalJson(marshalled)
+	}
+}
+
+// canonicalJson re-encodes a json document with sorted object keys. If it isn't valid json, it is returned unchanged.
+func canonicalJson(raw []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		return raw
+	}
+	// encoding/json always writes map keys in sorted order
+	canonical, err := json.Marshal(parsed)
+	if err != nil {
+		return raw
+	}
+	return canonical
+}
+
+// peekCustomBody reads the contents of a custom body without consuming it.
+func peekCustomBody(body aurestclientapi.CustomRequestBody) ([]byte, bool) {
+	switch reader := body.BodyReader.(type) {
+	case nil:
+		return []byte{}, true
+	case *bytes.Buffer:
+		return reader.Bytes(), true
+	case io.ReadSeeker:
+		offset, err := reader.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, false
+		}
+		contents, err := io.ReadAll(reader)
+		if _, err2 := reader.Seek(offset, io.SeekStart); err != nil || err2 != nil {
+			return nil, false
+		}
+		return contents, true
+	default:
+		return nil, false
+	}
+}
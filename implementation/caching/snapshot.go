@@ -0,0 +1,74 @@
+package aurestcaching
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const snapshotFormatVersion = 1
+
+type cacheSnapshot struct {
+	Version int                  `json:"version"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Key   string     `json:"key"`
+	Entry CacheEntry `json:"entry"`
+}
+
+// Snapshot writes all current cache entries to w as json.
+//
+// The recorded times of the entries are preserved, so after a Restore, entries still expire at the correct time.
+// Entries are written from least to most recently used, so Restore also recreates the usage order.
+//
+// Safe to call while the cache is in use, but of course requests completing during the call may or may not
+// be included.
+func (c *CachingImpl) Snapshot(w io.Writer) error {
+	snapshot := cacheSnapshot{
+		Version: snapshotFormatVersion,
+		Entries: make([]cacheSnapshotEntry, 0),
+	}
+	c.Cache.Reverse(func(key interface{}, value interface{}) bool {
+		keyStr, ok := key.(string)
+		if !ok {
+			return true
+		}
+		entry, ok := value.(CacheEntry)
+		if !ok {
+			return true
+		}
+		snapshot.Entries = append(snapshot.Entries, cacheSnapshotEntry{
+			Key:   keyStr,
+			Entry: entry,
+		})
+		return true
+	})
+
+	return json.NewEncoder(w).Encode(&snapshot)
+}
+
+// Restore reads cache entries written by Snapshot from r and adds them to the cache.
+//
+// Entries that have already exceeded the retention time are skipped. Existing entries with the same key
+// are overwritten.
+//
+// If the cache is smaller than the snapshot, the least recently used entries are evicted as usual.
+func (c *CachingImpl) Restore(r io.Reader) error {
+	snapshot := cacheSnapshot{}
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != snapshotFormatVersion {
+		return fmt.Errorf("unsupported cache snapshot version %d", snapshot.Version)
+	}
+
+	now := c.Now()
+	for _, e := range snapshot.Entries {
+		if now.Sub(e.Entry.Recorded) < c.RetentionTime {
+			c.set(e.Key, e.Entry)
+		}
+	}
+	return nil
+}
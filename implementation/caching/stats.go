@@ -0,0 +1,154 @@
+package aurestcaching
+
+import (
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"time"
+)
+
+type cacheCounters struct {
+	hits      uint64
+	misses    uint64
+	invalid   uint64
+	evictions uint64
+}
+
+// CacheStats is a point in time view of the state of a CachingImpl, see Stats().
+type CacheStats struct {
+	Entries int
+	// Bytes is the total size of the stored response bodies and headers (as json).
+	Bytes int
+
+	Hits      uint64
+	Misses    uint64
+	Invalid   uint64
+	Evictions uint64
+	// HitRatio is Hits / (Hits + Misses + Invalid), or 0 if there have not been any lookups yet.
+	HitRatio float64
+
+	// AgeDistribution counts the current entries by age, relative to the retention time.
+	AgeDistribution CacheAgeDistribution
+}
+
+// CacheAgeDistribution counts entries by age in quarters of the retention time.
+//
+// Expired entries are still counted until they are removed on their next lookup or evicted.
+type CacheAgeDistribution struct {
+	FirstQuarter  int
+	SecondQuarter int
+	ThirdQuarter  int
+	FourthQuarter int
+	Expired       int
+}
+
+type CacheEntryStatus string
+
+const (
+	CacheEntryValid   CacheEntryStatus = "valid"
+	CacheEntryExpired CacheEntryStatus = "expired"
+	CacheEntryInvalid CacheEntryStatus = "invalid"
+)
+
+// CacheEntryInfo describes a single cache entry, see Entries().
+type CacheEntryInfo struct {
+	// Key is the cache key, with secrets in urls masked by the Redactor.
+	Key    string
+	Age    time.Duration
+	Status CacheEntryStatus
+	// Bytes is the size of the stored response body and headers (as json).
+	Bytes          int
+	ResponseStatus int
+}
+
+// Stats returns statistics about the cache.
+//
+// Safe to call concurrently with requests.
+func (c *CachingImpl) Stats() CacheStats {
+	c.statsMutex.Lock()
+	counters := c.counters
+	c.statsMutex.Unlock()
+
+	result := CacheStats{
+		Hits:      counters.hits,
+		Misses:    counters.misses,
+		Invalid:   counters.invalid,
+		Evictions: counters.evictions,
+	}
+	if lookups := counters.hits + counters.misses + counters.invalid; lookups > 0 {
+		result.HitRatio = float64(counters.hits) / float64(lookups)
+	}
+
+	c.Entries(func(info CacheEntryInfo) bool {
+		result.Entries++
+		result.Bytes += info.Bytes
+		if info.Status == CacheEntryExpired || c.RetentionTime <= 0 {
+			result.AgeDistribution.Expired++
+		} else {
+			switch quarter := 4 * info.Age / c.RetentionTime; {
+			case quarter <= 0:
+				result.AgeDistribution.FirstQuarter++
+			case quarter == 1:
+				result.AgeDistribution.SecondQuarter++
+			case quarter == 2:
+				result.AgeDistribution.ThirdQuarter++
+			default:
+				result.AgeDistribution.FourthQuarter++
+			}
+		}
+		return true
+	})
+	return result
+}
+
+// Entries calls iter for each current cache entry, from most to least recently used, until iter returns false.
+//
+// Does not count as a use of the entries. Safe to call concurrently with requests, but iter must not
+// call into the cache.
+func (c *CachingImpl) Entries(iter func(info CacheEntryInfo) bool) {
+	now := c.Now()
+	redactor := aurestredaction.Use(c.Redactor)
+	c.Cache.Range(func(key interface{}, value interface{}) bool {
+		keyStr, _ := key.(string)
+		info := CacheEntryInfo{
+			Key:    redactor.Text(keyStr),
+			Status: CacheEntryInvalid,
+		}
+		if entry, ok := value.(CacheEntry); ok {
+			info.Age = now.Sub(entry.Recorded)
+			info.Bytes = len(entry.ResponseBodyJson) + len(entry.ResponseHeaderJson)
+			info.ResponseStatus = entry.ResponseStatus
+			if info.Age < c.RetentionTime {
+				info.Status = CacheEntryValid
+			} else {
+				info.Status = CacheEntryExpired
+			}
+		}
+		return iter(info)
+	})
+}
+
+func (c *CachingImpl) set(key string, entry CacheEntry) {
+	_, _, _, _, evicted := c.Cache.SetEvicted(key, entry)
+	if evicted {
+		c.statsMutex.Lock()
+		c.counters.evictions++
+		c.statsMutex.Unlock()
+	}
+}
+
+func (c *CachingImpl) countHit() {
+	c.statsMutex.Lock()
+	c.counters.hits++
+	c.statsMutex.Unlock()
+}
+
+func (c *CachingImpl) countMiss() {
+	c.statsMutex.Lock()
+	c.counters.misses++
+	c.statsMutex.Unlock()
+}
+
+func (c *CachingImpl) countInvalid() {
+	c.statsMutex.Lock()
+	c.counters.invalid++
+	c.statsMutex.Unlock()
+}
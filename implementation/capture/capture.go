@@ -4,23 +4,49 @@ import (
 	"context"
 	"fmt"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
 )
 
 type RequestCaptureImpl struct {
 	Wrapped   aurestclientapi.Client
+	Redactor  *aurestredaction.Redactor
 	recording []string
 }
 
-func New(wrapped aurestclientapi.Client) aurestclientapi.Client {
+type CaptureOptions struct {
+	// RedactorOrNil masks secrets in the captured urls and bodies. Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
+}
+
+// New builds a request capture layer.
+//
+// You can optionally add a CaptureOptions instance to your call. The ... is really just so it's an optional argument.
+func New(wrapped aurestclientapi.Client, additionalOptions ...CaptureOptions) aurestclientapi.Client {
 	return &RequestCaptureImpl{
 		Wrapped:   wrapped,
+		Redactor:  redactorFromOptions(additionalOptions),
 		recording: make([]string, 0),
 	}
 }
 
-func (c *RequestCaptureImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
-	requestStr := fmt.Sprintf("%s %s %v", method, requestUrl, requestBody)
+func redactorFromOptions(additionalOptions []CaptureOptions) *aurestredaction.Redactor {
+	var redactor *aurestredaction.Redactor
+	for _, o := range additionalOptions {
+		if o.RedactorOrNil != nil {
+			redactor = o.RedactorOrNil
+		}
+	}
+	return redactor
+}
+
+func (c *RequestCaptureImpl) capture(method string, requestUrl string, requestBody interface{}) {
+	redactor := aurestredaction.Use(c.Redactor)
+	requestStr := fmt.Sprintf("%s %s %v", method, redactor.Url(requestUrl), redactor.Body(requestBody))
 	c.recording = append(c.recording, requestStr)
+}
+
+func (c *RequestCaptureImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	c.capture(method, requestUrl, requestBody)
 	return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
 }
 
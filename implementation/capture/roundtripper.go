@@ -1,20 +1,18 @@
 package aurestcapture
 
 import (
-	"fmt"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
 	"io"
 	"net/http"
 	"strings"
 )
 
-func NewRoundTripper(wrapped aurestclientapi.Client) http.RoundTripper {
-	return &RequestCaptureImpl{Wrapped: wrapped}
+func NewRoundTripper(wrapped aurestclientapi.Client, additionalOptions ...CaptureOptions) http.RoundTripper {
+	return &RequestCaptureImpl{Wrapped: wrapped, Redactor: redactorFromOptions(additionalOptions)}
 }
 
 func (c *RequestCaptureImpl) RoundTrip(req *http.Request) (*http.Response, error) {
-	requestStr := fmt.Sprintf("%s %s %v", req.Method, req.URL.String(), req.Body)
-	c.recording = append(c.recording, requestStr)
+	c.capture(req.Method, req.URL.String(), req.Body)
 
 	var bodyDto *[]byte
 	parsedResponse := aurestclientapi.ParsedResponse{
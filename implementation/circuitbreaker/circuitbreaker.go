@@ -0,0 +1,391 @@
+package aurestcircuitbreaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown state %d", int(s))
+	}
+}
+
+// TripConditionCallback decides whether the outcome of a request counts as a failure for the circuit breaker.
+type TripConditionCallback func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool
+
+// StateChangeCallback is called whenever the circuit breaker changes state.
+type StateChangeCallback func(ctx context.Context, name string, from State, to State)
+
+type CircuitBreakerOptions struct {
+	// Name identifies the circuit breaker in log messages, errors and callbacks.
+	Name string
+
+	// ConsecutiveFailures trips the circuit breaker after this many failures in a row. 0 disables this check.
+	ConsecutiveFailures int
+
+	// FailureRateThreshold trips the circuit breaker if the fraction of failed requests during the last Window
+	// reaches this value (e.g. 0.5), but only if there were at least MinimumRequests. 0 disables this check.
+	FailureRateThreshold float64
+	// MinimumRequests defaults to 10.
+	MinimumRequests int
+	// Window defaults to 60 seconds.
+	Window time.Duration
+
+	// OpenTimeout is how long the circuit breaker stays open before letting probe requests through. Defaults to 60 seconds.
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests is the number of probe requests in half-open state. If all of them succeed, the circuit
+	// breaker closes, if any of them fails, it opens again. Defaults to 1.
+	HalfOpenMaxRequests int
+
+	// TripConditionOrNil determines what counts as a failure. Defaults to DefaultTripCondition.
+	TripConditionOrNil TripConditionCallback
+
+	// StateChangeOrNil is called on every state change.
+	StateChangeOrNil StateChangeCallback
+}
+
+type CircuitBreakerImpl struct {
+	Wrapped aurestclientapi.Client
+	Name    string
+
+	ConsecutiveFailures  int
+	FailureRateThreshold float64
+	MinimumRequests      int
+	Window               time.Duration
+	OpenTimeout          time.Duration
+	HalfOpenMaxRequests  int
+
+	TripCondition TripConditionCallback
+	StateChange   StateChangeCallback
+
+	RejectedMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+
+	mu                sync.Mutex
+	state             State
+	generation        uint64
+	openedAt          time.Time
+	consecutive       int
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	buckets           [windowBuckets]windowBucket
+}
+
+const windowBuckets = 10
+
+type windowBucket struct {
+	index    int64
+	requests int
+	failures int
+}
+
+// CircuitOpenError is returned without making the request while the circuit breaker is open, or when
+// the maximum number of probe requests is already in flight in half-open state.
+//
+// It is a non-tripping error, so other circuit breakers further up do not count it, and
+// aurestretry.NeverOnNonTripping prevents pointless retries.
+type CircuitOpenError struct {
+	ctx   context.Context
+	Name  string
+	State State
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker %s is %s", e.Name, e.State)
+}
+
+// implement NonTrippingError
+
+func (e *CircuitOpenError) Ctx() context.Context {
+	return e.ctx
+}
+
+func (e *CircuitOpenError) IsNonTrippingError() bool {
+	return true
+}
+
+// IsCircuitOpen checks whether err is (or wraps) a *CircuitOpenError.
+func IsCircuitOpen(err error) bool {
+	var circuitOpenError *CircuitOpenError
+	return errors.As(err, &circuitOpenError)
+}
+
+// DefaultTripCondition counts errors (except non-tripping errors and cancellation by the caller)
+// and 5xx responses as failures.
+func DefaultTripCondition(_ context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+	if err != nil {
+		return !aurestnontripping.Is(err) && !errors.Is(err, context.Canceled)
+	}
+	return response != nil && response.Status >= 500
+}
+
+// New builds a circuit breaker that opens after consecutiveFailures failures in a row, and lets a probe request
+// through after openTimeout.
+//
+// Insert this into your stack below the retry. Unlike go-autumn-restclient-circuitbreaker, it does not have
+// a timeout, so if you need one, put a timeout layer below it.
+func New(wrapped aurestclientapi.Client, name string, consecutiveFailures int, openTimeout time.Duration) aurestclientapi.Client {
+	return NewWithOptions(wrapped, CircuitBreakerOptions{
+		Name:                name,
+		ConsecutiveFailures: consecutiveFailures,
+		OpenTimeout:         openTimeout,
+	})
+}
+
+// NewWithOptions builds a circuit breaker with more control, see CircuitBreakerOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts CircuitBreakerOptions) aurestclientapi.Client {
+	instance := &CircuitBreakerImpl{
+		Wrapped:                 wrapped,
+		Name:                    opts.Name,
+		ConsecutiveFailures:     opts.ConsecutiveFailures,
+		FailureRateThreshold:    opts.FailureRateThreshold,
+		MinimumRequests:         10,
+		Window:                  60 * time.Second,
+		OpenTimeout:             60 * time.Second,
+		HalfOpenMaxRequests:     1,
+		TripCondition:           DefaultTripCondition,
+		StateChange:             opts.StateChangeOrNil,
+		RejectedMetricsCallback: doNothingMetricsCallback,
+		Now:                     time.Now,
+	}
+	if opts.MinimumRequests > 0 {
+		instance.MinimumRequests = opts.MinimumRequests
+	}
+	if opts.Window > 0 {
+		instance.Window = opts.Window
+	}
+	if opts.OpenTimeout > 0 {
+		instance.OpenTimeout = opts.OpenTimeout
+	}
+	if opts.HalfOpenMaxRequests > 0 {
+		instance.HalfOpenMaxRequests = opts.HalfOpenMaxRequests
+	}
+	if opts.TripConditionOrNil != nil {
+		instance.TripCondition = opts.TripConditionOrNil
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// rejectedMetricsCallback is called for each request that is rejected because the circuit breaker is open.
+//
+// The callback may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	rejectedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	breakerClient, ok := client.(*CircuitBreakerImpl)
+	if !ok {
+		return
+	}
+
+	if rejectedMetricsCallback != nil {
+		breakerClient.RejectedMetricsCallback = rejectedMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func (c *CircuitBreakerImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	generation, err := c.beforeRequest(ctx)
+	if err != nil {
+		c.RejectedMetricsCallback(ctx, method, requestUrl, 0, err, 0, 0)
+		return err
+	}
+
+	err = c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+
+	cancelled := errors.Is(ctx.Err(), context.Canceled)
+	c.afterRequest(ctx, generation, c.TripCondition(ctx, response, err), cancelled)
+	return err
+}
+
+// State returns the current state of the circuit breaker.
+func (c *CircuitBreakerImpl) State() State {
+	c.mu.Lock()
+	change := c.checkOpenTimeout(c.Now())
+	state := c.state
+	c.mu.Unlock()
+
+	c.notify(context.Background(), change)
+	return state
+}
+
+type stateChange struct {
+	from State
+	to   State
+}
+
+func (c *CircuitBreakerImpl) beforeRequest(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	change := c.checkOpenTimeout(c.Now())
+	generation := c.generation
+	var err error
+	switch c.state {
+	case StateOpen:
+		err = &CircuitOpenError{ctx: ctx, Name: c.Name, State: c.state}
+	case StateHalfOpen:
+		if c.halfOpenInFlight >= c.HalfOpenMaxRequests {
+			err = &CircuitOpenError{ctx: ctx, Name: c.Name, State: c.state}
+		} else {
+			c.halfOpenInFlight++
+		}
+	}
+	c.mu.Unlock()
+
+	c.notify(ctx, change)
+	return generation, err
+}
+
+// afterRequest records the outcome of a request.
+//
+// A half-open probe that was cancelled by the caller counts as neither success nor failure, it only frees up its slot.
+func (c *CircuitBreakerImpl) afterRequest(ctx context.Context, generation uint64, failed bool, cancelled bool) {
+	c.mu.Lock()
+	var change *stateChange
+	if generation == c.generation {
+		// results of requests started in an earlier state are ignored
+		switch c.state {
+		case StateClosed:
+			change = c.recordClosed(failed)
+		case StateHalfOpen:
+			if cancelled {
+				c.halfOpenInFlight--
+			} else if failed {
+				change = c.transition(StateOpen)
+			} else {
+				c.halfOpenSuccesses++
+				if c.halfOpenSuccesses >= c.HalfOpenMaxRequests {
+					change = c.transition(StateClosed)
+				}
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	c.notify(ctx, change)
+}
+
+// recordClosed records an outcome in closed state and trips if a threshold is reached.
+//
+// Must be called with the mutex held.
+func (c *CircuitBreakerImpl) recordClosed(failed bool) *stateChange {
+	bucket := c.currentBucket()
+	bucket.requests++
+	if failed {
+		bucket.failures++
+		c.consecutive++
+	} else {
+		c.consecutive = 0
+	}
+
+	if c.ConsecutiveFailures > 0 && c.consecutive >= c.ConsecutiveFailures {
+		return c.transition(StateOpen)
+	}
+	if c.FailureRateThreshold > 0 {
+		requests, failures := c.windowCounts()
+		if requests >= c.MinimumRequests && float64(failures)/float64(requests) >= c.FailureRateThreshold {
+			return c.transition(StateOpen)
+		}
+	}
+	return nil
+}
+
+// checkOpenTimeout moves from open to half-open once the open timeout has passed.
+//
+// Must be called with the mutex held.
+func (c *CircuitBreakerImpl) checkOpenTimeout(now time.Time) *stateChange {
+	if c.state == StateOpen && now.Sub(c.openedAt) >= c.OpenTimeout {
+		return c.transition(StateHalfOpen)
+	}
+	return nil
+}
+
+// transition changes the state and resets all counters.
+//
+// Must be called with the mutex held.
+func (c *CircuitBreakerImpl) transition(to State) *stateChange {
+	change := &stateChange{from: c.state, to: to}
+	c.state = to
+	c.generation++
+	c.consecutive = 0
+	c.halfOpenInFlight = 0
+	c.halfOpenSuccesses = 0
+	c.buckets = [windowBuckets]windowBucket{}
+	if to == StateOpen {
+		c.openedAt = c.Now()
+	}
+	return change
+}
+
+func (c *CircuitBreakerImpl) notify(ctx context.Context, change *stateChange) {
+	if change == nil {
+		return
+	}
+	aulogging.Logger.Ctx(ctx).Info().Printf("circuit breaker %s changed state from %s to %s", c.Name, change.from, change.to)
+	if c.StateChange != nil {
+		c.StateChange(ctx, c.Name, change.from, change.to)
+	}
+}
+
+// currentBucket returns the window bucket for the current time, resetting it if it is from an earlier window.
+//
+// Must be called with the mutex held.
+func (c *CircuitBreakerImpl) currentBucket() *windowBucket {
+	index := c.bucketIndex()
+	bucket := &c.buckets[index%windowBuckets]
+	if bucket.index != index {
+		*bucket = windowBucket{index: index}
+	}
+	return bucket
+}
+
+// windowCounts sums up the requests and failures during the window.
+//
+// Must be called with the mutex held.
+func (c *CircuitBreakerImpl) windowCounts() (int, int) {
+	index := c.bucketIndex()
+	requests, failures := 0, 0
+	for _, bucket := range c.buckets {
+		if bucket.index > index-windowBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+func (c *CircuitBreakerImpl) bucketIndex() int64 {
+	bucketDuration := c.Window / windowBuckets
+	if bucketDuration <= 0 {
+		bucketDuration = 1
+	}
+	return c.Now().UnixNano() / int64(bucketDuration)
+}
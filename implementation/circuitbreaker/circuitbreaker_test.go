@@ -0,0 +1,215 @@
+package aurestcircuitbreaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func tstMock() aurestclientapi.Client {
+	mockClient := aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://ok <nil>": {
+				Status: 200,
+			},
+			"GET http://500 <nil>": {
+				Status: 500,
+			},
+		},
+		map[string]error{
+			"GET http://err <nil>":         errors.New("some transport error"),
+			"GET http://nontripping <nil>": aurestnontripping.New(context.Background(), errors.New("invalid json")),
+		},
+	)
+	return aurestcapture.New(mockClient)
+}
+
+type tstClock struct {
+	now time.Time
+}
+
+func (c *tstClock) Now() time.Time {
+	return c.now
+}
+
+func tstCut(mock aurestclientapi.Client, opts CircuitBreakerOptions) (*CircuitBreakerImpl, *tstClock, *[]string) {
+	changes := make([]string, 0)
+	opts.Name = "test"
+	opts.StateChangeOrNil = func(ctx context.Context, name string, from State, to State) {
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, from, to))
+	}
+	cut := NewWithOptions(mock, opts).(*CircuitBreakerImpl)
+	clock := &tstClock{now: time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)}
+	cut.Now = clock.Now
+	return cut, clock, &changes
+}
+
+func tstPerform(cut aurestclientapi.Client, url string) error {
+	return cut.Perform(context.Background(), "GET", url, nil, &aurestclientapi.ParsedResponse{})
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut, clock, changes := tstCut(mock, CircuitBreakerOptions{
+		ConsecutiveFailures: 3,
+		OpenTimeout:         10 * time.Second,
+	})
+
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Nil(t, tstPerform(cut, "http://ok"))
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Equal(t, StateClosed, cut.State())
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Equal(t, StateOpen, cut.State())
+
+	// open - requests are rejected without being made
+	aurestcapture.ResetRecording(mock)
+	err := tstPerform(cut, "http://ok")
+	require.True(t, IsCircuitOpen(err))
+	require.True(t, aurestnontripping.Is(err))
+	require.Equal(t, []string{}, aurestcapture.GetRecording(mock))
+
+	// after the timeout, a failing probe opens it again
+	clock.now = clock.now.Add(10 * time.Second)
+	require.Nil(t, tstPerform(cut, "http://500")) // a 500 is not an error, but still counts as a failure
+	require.Equal(t, StateOpen, cut.State())
+
+	// and a successful probe closes it
+	clock.now = clock.now.Add(10 * time.Second)
+	require.Nil(t, tstPerform(cut, "http://ok"))
+	require.Equal(t, StateClosed, cut.State())
+
+	require.Equal(t, []string{
+		"test: closed -> open",
+		"test: open -> half-open",
+		"test: half-open -> open",
+		"test: open -> half-open",
+		"test: half-open -> closed",
+	}, *changes)
+}
+
+func TestNonTrippingErrorsDoNotCount(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, _, _ := tstCut(tstMock(), CircuitBreakerOptions{
+		ConsecutiveFailures: 2,
+	})
+
+	for i := 0; i < 5; i++ {
+		require.NotNil(t, tstPerform(cut, "http://nontripping"))
+	}
+	require.Equal(t, StateClosed, cut.State())
+}
+
+func TestFailureRateInRollingWindow(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, clock, _ := tstCut(tstMock(), CircuitBreakerOptions{
+		FailureRateThreshold: 0.5,
+		MinimumRequests:      4,
+		Window:               10 * time.Second,
+	})
+
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Nil(t, tstPerform(cut, "http://ok"))
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Equal(t, StateClosed, cut.State()) // not enough requests yet
+
+	// the old requests drop out of the window
+	clock.now = clock.now.Add(11 * time.Second)
+	require.Nil(t, tstPerform(cut, "http://ok"))
+	require.Nil(t, tstPerform(cut, "http://ok"))
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Equal(t, StateClosed, cut.State())
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Equal(t, StateOpen, cut.State())
+}
+
+func TestHalfOpenLimitsProbes(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	blocking := &blockingClient{release: make(chan struct{}), started: make(chan struct{})}
+	cut, clock, _ := tstCut(blocking, CircuitBreakerOptions{
+		ConsecutiveFailures: 1,
+		OpenTimeout:         time.Second,
+	})
+	blocking.fail = true
+	go func() {
+		<-blocking.started
+		blocking.release <- struct{}{}
+	}()
+	require.NotNil(t, tstPerform(cut, "http://blocking"))
+	require.Equal(t, StateOpen, cut.State())
+
+	clock.now = clock.now.Add(time.Second)
+	blocking.fail = false
+	done := make(chan error)
+	go func() {
+		done <- tstPerform(cut, "http://blocking")
+	}()
+	<-blocking.started
+
+	// the probe is in flight, so further requests are rejected
+	require.True(t, IsCircuitOpen(tstPerform(cut, "http://blocking")))
+
+	blocking.release <- struct{}{}
+	require.Nil(t, <-done)
+	require.Equal(t, StateClosed, cut.State())
+}
+
+type blockingClient struct {
+	started chan struct{}
+	release chan struct{}
+	fail    bool
+}
+
+func (c *blockingClient) Perform(_ context.Context, _ string, _ string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	c.started <- struct{}{}
+	<-c.release
+	if c.fail {
+		return errors.New("some transport error")
+	}
+	return nil
+}
+
+func TestCancelledProbeDoesNotChangeState(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, clock, changes := tstCut(tstMock(), CircuitBreakerOptions{
+		ConsecutiveFailures: 1,
+		OpenTimeout:         time.Second,
+	})
+	require.NotNil(t, tstPerform(cut, "http://err"))
+	require.Equal(t, StateOpen, cut.State())
+
+	// a probe the caller gave up on counts neither as success nor as failure
+	clock.now = clock.now.Add(time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Nil(t, cut.Perform(ctx, "GET", "http://ok", nil, &aurestclientapi.ParsedResponse{}))
+	require.Equal(t, StateHalfOpen, cut.State())
+	require.NotNil(t, cut.Perform(ctx, "GET", "http://err", nil, &aurestclientapi.ParsedResponse{}))
+	require.Equal(t, StateHalfOpen, cut.State())
+
+	// and it frees its slot for the next probe
+	require.Nil(t, tstPerform(cut, "http://ok"))
+	require.Equal(t, StateClosed, cut.State())
+
+	require.Equal(t, []string{
+		"test: closed -> open",
+		"test: open -> half-open",
+		"test: half-open -> closed",
+	}, *changes)
+}
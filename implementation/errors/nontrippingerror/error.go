@@ -27,6 +27,10 @@ func (e *Impl) Error() string {
 	return e.err.Error()
 }
 
+func (e *Impl) Unwrap() error {
+	return e.err
+}
+
 // implement NonTrippingError
 
 func (e *Impl) Ctx() context.Context {
@@ -0,0 +1,300 @@
+package aurestfallback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestresponsecopy "github.com/StephanHCB/go-autumn-restclient/implementation/internal/responsecopy"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"github.com/tidwall/tinylru"
+	"net/http"
+	"time"
+)
+
+// FallbackHeaderName is set on responses that were filled in by the fallback layer. The value is the
+// source of the fallback response, see SourceLastKnownGood, SourceFunction and SourceStatic.
+const FallbackHeaderName = "X-Aurest-Fallback"
+
+const (
+	SourceLastKnownGood = "last-known-good"
+	SourceFunction      = "function"
+	SourceStatic        = "static"
+)
+
+// FallbackConditionCallback decides whether the outcome of a request calls for a fallback response.
+type FallbackConditionCallback func(ctx context.Context, method string, requestUrl string, response *aurestclientapi.ParsedResponse, err error) bool
+
+// FallbackFunction fills in response as a replacement for a failed request. err is the error of the failed
+// request, if any.
+//
+// Return an error if no fallback response can be provided.
+type FallbackFunction func(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse, err error) error
+
+type FallbackOptions struct {
+	// FallbackConditionOrNil determines when to fall back. Defaults to DefaultFallbackCondition.
+	FallbackConditionOrNil FallbackConditionCallback
+
+	// LastKnownGood remembers the last successful (2xx) response per key, and uses it as the fallback.
+	LastKnownGood bool
+	// LastKnownGoodMaxAge limits how old a remembered response may be. 0 means no limit.
+	LastKnownGoodMaxAge time.Duration
+	// CacheKeyFunctionOrNil determines the key for LastKnownGood. Defaults to method and url.
+	CacheKeyFunctionOrNil aurestclientapi.CacheKeyFunction
+	// CacheSize is the number of remembered responses, defaults to 256.
+	CacheSize int
+
+	// FallbackFunctionOrNil is used if there is no last known good response.
+	FallbackFunctionOrNil FallbackFunction
+
+	// StaticResponseOrNil is used if there is neither a last known good response nor a fallback function
+	// (or it returned an error). Its Body is copied into the response by marshalling it to json.
+	StaticResponseOrNil *aurestclientapi.ParsedResponse
+
+	// RedactorOrNil masks secrets in urls and errors in log messages. Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
+}
+
+type FallbackImpl struct {
+	Wrapped aurestclientapi.Client
+
+	FallbackCondition   FallbackConditionCallback
+	LastKnownGood       bool
+	LastKnownGoodMaxAge time.Duration
+	CacheKeyFunction    aurestclientapi.CacheKeyFunction
+	Cache               *tinylru.LRU
+	FallbackFunction    FallbackFunction
+	StaticResponse      *aurestclientapi.ParsedResponse
+
+	FallbackMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	// Redactor masks secrets in urls and errors in log messages. nil uses aurestredaction.Default().
+	Redactor *aurestredaction.Redactor
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+}
+
+type lastKnownGoodEntry struct {
+	recorded           time.Time
+	responseHeaderJson []byte
+	responseBodyJson   []byte
+	responseStatus     int
+}
+
+// DefaultFallbackCondition falls back on errors (except cancellation by the caller) and 5xx responses.
+func DefaultFallbackCondition(_ context.Context, _ string, _ string, response *aurestclientapi.ParsedResponse, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return response.Status >= 500
+}
+
+// IsFallback tells whether response was filled in by the fallback layer.
+func IsFallback(response *aurestclientapi.ParsedResponse) bool {
+	return FallbackSource(response) != ""
+}
+
+// FallbackSource returns where a fallback response came from, or "" if response is not a fallback.
+func FallbackSource(response *aurestclientapi.ParsedResponse) string {
+	if response == nil || response.Header == nil {
+		return ""
+	}
+	return response.Header.Get(FallbackHeaderName)
+}
+
+// New builds a fallback layer that fills in staticResponse if a request fails.
+//
+// Insert this into your stack above the retry, so it only kicks in once all retries have failed.
+func New(wrapped aurestclientapi.Client, staticResponse *aurestclientapi.ParsedResponse) aurestclientapi.Client {
+	return NewWithOptions(wrapped, FallbackOptions{
+		StaticResponseOrNil: staticResponse,
+	})
+}
+
+// NewWithOptions builds a fallback layer with more control, see FallbackOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts FallbackOptions) aurestclientapi.Client {
+	instance := &FallbackImpl{
+		Wrapped:                 wrapped,
+		FallbackCondition:       DefaultFallbackCondition,
+		LastKnownGood:           opts.LastKnownGood,
+		LastKnownGoodMaxAge:     opts.LastKnownGoodMaxAge,
+		CacheKeyFunction:        defaultKeyFunction,
+		FallbackFunction:        opts.FallbackFunctionOrNil,
+		StaticResponse:          opts.StaticResponseOrNil,
+		Redactor:                opts.RedactorOrNil,
+		FallbackMetricsCallback: doNothingMetricsCallback,
+		Now:                     time.Now,
+	}
+	if opts.FallbackConditionOrNil != nil {
+		instance.FallbackCondition = opts.FallbackConditionOrNil
+	}
+	if opts.CacheKeyFunctionOrNil != nil {
+		instance.CacheKeyFunction = opts.CacheKeyFunctionOrNil
+	}
+	if opts.LastKnownGood {
+		cacheSize := 256
+		if opts.CacheSize > 0 {
+			cacheSize = opts.CacheSize
+		}
+		instance.Cache = &tinylru.LRU{}
+		instance.Cache.Resize(cacheSize)
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// fallbackMetricsCallback is called whenever a fallback response is used, with the error of the failed request.
+//
+// The callback may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	fallbackMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	fallbackClient, ok := client.(*FallbackImpl)
+	if !ok {
+		return
+	}
+
+	if fallbackMetricsCallback != nil {
+		fallbackClient.FallbackMetricsCallback = fallbackMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func defaultKeyFunction(_ context.Context, method string, requestUrl string, _ interface{}) string {
+	return fmt.Sprintf("%s %s", method, requestUrl)
+}
+
+func (c *FallbackImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	// the failed request may leave data in response, the fallback starts over from what the caller passed in
+	original := aurestresponsecopy.NewLike(response)
+	err := c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+
+	var key string
+	if c.LastKnownGood {
+		key = c.CacheKeyFunction(ctx, method, requestUrl, requestBody)
+	}
+
+	if !c.FallbackCondition(ctx, method, requestUrl, response, err) {
+		if c.LastKnownGood && err == nil && response.Status >= 200 && response.Status < 300 {
+			c.remember(key, response)
+		}
+		return err
+	}
+
+	source, fallbackErr := c.fallback(ctx, key, method, requestUrl, requestBody, original, response, err)
+	if fallbackErr != nil {
+		// no fallback available, so the caller gets the original outcome
+		return err
+	}
+
+	redactor := aurestredaction.Use(c.Redactor)
+	aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err, requestUrl)).Printf("downstream %s %s failed, using %s fallback response", method, redactor.Url(requestUrl), source)
+	c.FallbackMetricsCallback(ctx, method, requestUrl, response.Status, err, 0, 0)
+	return nil
+}
+
+func (c *FallbackImpl) fallback(ctx context.Context, key string, method string, requestUrl string, requestBody interface{}, original *aurestclientapi.ParsedResponse, response *aurestclientapi.ParsedResponse, err error) (string, error) {
+	if c.LastKnownGood {
+		if entry, ok := c.lookup(key); ok {
+			if fillErr := c.fill(original, response, entry.responseStatus, entry.responseHeaderJson, entry.responseBodyJson, entry.recorded, SourceLastKnownGood); fillErr == nil {
+				return SourceLastKnownGood, nil
+			}
+		}
+	}
+
+	if c.FallbackFunction != nil {
+		candidate := aurestresponsecopy.NewLike(original)
+		if fnErr := c.FallbackFunction(ctx, method, requestUrl, requestBody, candidate, err); fnErr == nil {
+			aurestresponsecopy.CopyInto(response, candidate)
+			markAsFallback(response, SourceFunction)
+			return SourceFunction, nil
+		}
+	}
+
+	if c.StaticResponse != nil {
+		bodyJson, marshalErr := json.Marshal(c.StaticResponse.Body)
+		if marshalErr != nil {
+			return "", marshalErr
+		}
+		headerJson, marshalErr := json.Marshal(c.StaticResponse.Header)
+		if marshalErr != nil {
+			return "", marshalErr
+		}
+		if fillErr := c.fill(original, response, c.StaticResponse.Status, headerJson, bodyJson, c.Now(), SourceStatic); fillErr != nil {
+			return "", fillErr
+		}
+		return SourceStatic, nil
+	}
+
+	return "", errors.New("no fallback response available")
+}
+
+// fill replaces the contents of response, discarding anything the failed request left in it.
+//
+// original holds the response as the caller passed it in, see Perform.
+func (c *FallbackImpl) fill(original *aurestclientapi.ParsedResponse, response *aurestclientapi.ParsedResponse, status int, headerJson []byte, bodyJson []byte, recorded time.Time, source string) error {
+	candidate := aurestresponsecopy.NewLike(original)
+	if candidate.Body != nil {
+		if err := json.Unmarshal(bodyJson, candidate.Body); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(headerJson, &candidate.Header); err != nil {
+		return err
+	}
+	candidate.Status = status
+	candidate.Time = recorded
+
+	aurestresponsecopy.CopyInto(response, candidate)
+	markAsFallback(response, source)
+	return nil
+}
+
+func markAsFallback(response *aurestclientapi.ParsedResponse, source string) {
+	if response.Header == nil {
+		response.Header = http.Header{}
+	} else {
+		response.Header = response.Header.Clone()
+	}
+	response.Header.Set(FallbackHeaderName, source)
+}
+
+func (c *FallbackImpl) remember(key string, response *aurestclientapi.ParsedResponse) {
+	bodyJson, err := json.Marshal(response.Body)
+	headerJson, err2 := json.Marshal(&response.Header)
+	recorded := response.Time
+	if recorded.IsZero() {
+		recorded = c.Now()
+	}
+	if err == nil && err2 == nil {
+		c.Cache.Set(key, lastKnownGoodEntry{
+			recorded:           recorded,
+			responseHeaderJson: headerJson,
+			responseBodyJson:   bodyJson,
+			responseStatus:     response.Status,
+		})
+	}
+}
+
+func (c *FallbackImpl) lookup(key string) (lastKnownGoodEntry, bool) {
+	raw, ok := c.Cache.Get(key)
+	if !ok {
+		return lastKnownGoodEntry{}, false
+	}
+	entry, ok := raw.(lastKnownGoodEntry)
+	if !ok {
+		return lastKnownGoodEntry{}, false
+	}
+	if c.LastKnownGoodMaxAge > 0 && c.Now().Sub(entry.recorded) > c.LastKnownGoodMaxAge {
+		return lastKnownGoodEntry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,175 @@
+package aurestfallback
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type tstBody struct {
+	Name  string `json:"name"`
+	Count int    `json:"count,omitempty"`
+}
+
+type switchableClient struct {
+	wrapped aurestclientapi.Client
+	fail    bool
+}
+
+func (c *switchableClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	if c.fail {
+		// simulate an error body that was partially decoded
+		response.Body.(*tstBody).Count = 42
+		return errors.New("some transport error")
+	}
+	return c.wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+}
+
+func tstMock() *switchableClient {
+	return &switchableClient{
+		wrapped: aurestmock.New(
+			map[string]aurestclientapi.ParsedResponse{
+				"GET http://a/1 <nil>": {
+					Status: 200,
+					Header: http.Header{"Content-Type": []string{"application/json"}},
+					Body:   tstBody{Name: "live"},
+				},
+				"GET http://a/500 <nil>": {
+					Status: 500,
+					Body:   tstBody{Name: "error"},
+				},
+			},
+			map[string]error{},
+		),
+	}
+}
+
+func tstPerform(cut aurestclientapi.Client, requestUrl string) (*aurestclientapi.ParsedResponse, error) {
+	response := &aurestclientapi.ParsedResponse{Body: &tstBody{}}
+	err := cut.Perform(context.Background(), "GET", requestUrl, nil, response)
+	return response, err
+}
+
+func TestStatic(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := New(mock, &aurestclientapi.ParsedResponse{
+		Status: 200,
+		Body:   tstBody{Name: "static"},
+	})
+	used := 0
+	Instrument(cut, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+		used++
+	})
+
+	response, err := tstPerform(cut, "http://a/1")
+	require.Nil(t, err)
+	require.Equal(t, "live", response.Body.(*tstBody).Name)
+	require.False(t, IsFallback(response))
+
+	response, err = tstPerform(cut, "http://a/500")
+	require.Nil(t, err)
+	require.Equal(t, 200, response.Status)
+	require.Equal(t, &tstBody{Name: "static"}, response.Body)
+	require.Equal(t, SourceStatic, FallbackSource(response))
+
+	mock.fail = true
+	response, err = tstPerform(cut, "http://a/1")
+	require.Nil(t, err)
+	require.Equal(t, &tstBody{Name: "static"}, response.Body)
+	require.True(t, IsFallback(response))
+	require.Equal(t, 2, used)
+}
+
+func TestLastKnownGood(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	mock.wrapped.(*aurestmock.MockImpl).Now = func() time.Time { return now }
+	cut := NewWithOptions(mock, FallbackOptions{
+		LastKnownGood:       true,
+		LastKnownGoodMaxAge: time.Minute,
+	}).(*FallbackImpl)
+	cut.Now = func() time.Time { return now }
+
+	// no response known yet, so the original error is returned
+	mock.fail = true
+	_, err := tstPerform(cut, "http://a/1")
+	require.NotNil(t, err)
+
+	mock.fail = false
+	_, err = tstPerform(cut, "http://a/1")
+	require.Nil(t, err)
+
+	mock.fail = true
+	response, err := tstPerform(cut, "http://a/1")
+	require.Nil(t, err)
+	require.Equal(t, &tstBody{Name: "live"}, response.Body)
+	require.Equal(t, 200, response.Status)
+	require.Equal(t, now, response.Time)
+	require.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	require.Equal(t, SourceLastKnownGood, FallbackSource(response))
+
+	// too old
+	now = now.Add(2 * time.Minute)
+	_, err = tstPerform(cut, "http://a/1")
+	require.NotNil(t, err)
+}
+
+func TestFunction(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	mock.fail = true
+	cut := NewWithOptions(mock, FallbackOptions{
+		FallbackFunctionOrNil: func(_ context.Context, _ string, requestUrl string, _ interface{}, response *aurestclientapi.ParsedResponse, err error) error {
+			if requestUrl != "http://a/1" {
+				return errors.New("no fallback for this one")
+			}
+			response.Status = 203
+			response.Body.(*tstBody).Name = err.Error()
+			return nil
+		},
+		StaticResponseOrNil: &aurestclientapi.ParsedResponse{
+			Status: 200,
+			Body:   tstBody{Name: "static"},
+		},
+	})
+
+	response, err := tstPerform(cut, "http://a/1")
+	require.Nil(t, err)
+	require.Equal(t, 203, response.Status)
+	require.Equal(t, &tstBody{Name: "some transport error"}, response.Body)
+	require.Equal(t, SourceFunction, FallbackSource(response))
+
+	response, err = tstPerform(cut, "http://a/2")
+	require.Nil(t, err)
+	require.Equal(t, &tstBody{Name: "static"}, response.Body)
+	require.Equal(t, SourceStatic, FallbackSource(response))
+}
+
+func TestNoFallbackOnCancel(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cancelled := &cancellingClient{}
+	cut := New(cancelled, &aurestclientapi.ParsedResponse{Status: 200})
+
+	response := &aurestclientapi.ParsedResponse{}
+	err := cut.Perform(context.Background(), "GET", "http://a/1", nil, response)
+	require.Equal(t, context.Canceled, err)
+	require.False(t, IsFallback(response))
+}
+
+type cancellingClient struct{}
+
+func (c *cancellingClient) Perform(_ context.Context, _ string, _ string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	return context.Canceled
+}
@@ -0,0 +1,244 @@
+package auresthedging
+
+import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestresponsecopy "github.com/StephanHCB/go-autumn-restclient/implementation/internal/responsecopy"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeConditionCallback determines whether a request may be hedged, that is, sent more than once.
+//
+// Only return true for idempotent requests.
+type HedgeConditionCallback func(ctx context.Context, method string, requestUrl string, requestBody interface{}) bool
+
+type HedgingOptions struct {
+	// MaxHedges is the number of additional copies that may be sent, defaults to 1.
+	MaxHedges uint8
+
+	// Delay is how long to wait for a response before sending the next copy.
+	Delay time.Duration
+
+	// DelayPercentile, if set (e.g. 0.95), uses this percentile of the observed latencies as the delay instead,
+	// once MinSamples latencies have been observed. Until then, Delay is used.
+	DelayPercentile float64
+	// MinSamples defaults to 20.
+	MinSamples int
+
+	// HedgeConditionOrNil determines which requests are hedged. Defaults to GET, HEAD and OPTIONS requests
+	// without a custom request body.
+	HedgeConditionOrNil HedgeConditionCallback
+
+	// RedactorOrNil masks secrets in urls in log messages. Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
+}
+
+type HedgingImpl struct {
+	Wrapped aurestclientapi.Client
+
+	MaxHedges       uint8
+	Delay           time.Duration
+	DelayPercentile float64
+	MinSamples      int
+	HedgeCondition  HedgeConditionCallback
+
+	HedgeSentMetricsCallback aurestclientapi.MetricsCallbackFunction
+	HedgeWonMetricsCallback  aurestclientapi.MetricsCallbackFunction
+
+	// Redactor masks secrets in urls in log messages. nil uses aurestredaction.Default().
+	Redactor *aurestredaction.Redactor
+
+	latencies *latencyWindow
+}
+
+const latencyWindowSize = 128
+
+// New builds a hedging layer that sends a second copy of a GET, HEAD or OPTIONS request if there is no
+// response after delay, and returns whichever response arrives first.
+//
+// Insert this into your stack below the retry and above the circuit breaker (if any). Every copy is a
+// real request, so hedging increases the load on the downstream.
+//
+// Copies are only sent when the delay expires. Once no copy is in flight any more, the last failure is
+// returned, so failed requests are never repeated right away.
+func New(wrapped aurestclientapi.Client, delay time.Duration) aurestclientapi.Client {
+	return NewWithOptions(wrapped, HedgingOptions{
+		Delay: delay,
+	})
+}
+
+// NewWithOptions builds a hedging layer with more control, see HedgingOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts HedgingOptions) aurestclientapi.Client {
+	instance := &HedgingImpl{
+		Wrapped:                  wrapped,
+		MaxHedges:                1,
+		Delay:                    opts.Delay,
+		DelayPercentile:          opts.DelayPercentile,
+		MinSamples:               20,
+		HedgeCondition:           defaultHedgeCondition,
+		HedgeSentMetricsCallback: doNothingMetricsCallback,
+		HedgeWonMetricsCallback:  doNothingMetricsCallback,
+		Redactor:                 opts.RedactorOrNil,
+		latencies:                &latencyWindow{},
+	}
+	if opts.MaxHedges > 0 {
+		instance.MaxHedges = opts.MaxHedges
+	}
+	if opts.MinSamples > 0 {
+		instance.MinSamples = opts.MinSamples
+	}
+	if opts.HedgeConditionOrNil != nil {
+		instance.HedgeCondition = opts.HedgeConditionOrNil
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// hedgeSentMetricsCallback is called when an additional copy of a request is sent, with the delay as latency.
+// hedgeWonMetricsCallback is called when the response of an additional copy was used.
+//
+// Either of the callbacks may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	hedgeSentMetricsCallback aurestclientapi.MetricsCallbackFunction,
+	hedgeWonMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	hedgingClient, ok := client.(*HedgingImpl)
+	if !ok {
+		return
+	}
+
+	if hedgeSentMetricsCallback != nil {
+		hedgingClient.HedgeSentMetricsCallback = hedgeSentMetricsCallback
+	}
+	if hedgeWonMetricsCallback != nil {
+		hedgingClient.HedgeWonMetricsCallback = hedgeWonMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func defaultHedgeCondition(_ context.Context, method string, _ string, requestBody interface{}) bool {
+	if _, ok := requestBody.(aurestclientapi.CustomRequestBody); ok {
+		// the body reader cannot be shared between copies
+		return false
+	}
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+type copyResult struct {
+	index    int
+	response *aurestclientapi.ParsedResponse
+	err      error
+	latency  time.Duration
+}
+
+func (r copyResult) successful() bool {
+	return r.err == nil && r.response.Status < 500
+}
+
+func (c *HedgingImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	if !c.HedgeCondition(ctx, method, requestUrl, requestBody) {
+		return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	}
+
+	// cancels all copies that are still running once we have a result
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maxCopies := int(c.MaxHedges) + 1
+	results := make(chan copyResult, maxCopies)
+	delay := c.currentDelay()
+
+	sendCopy := func(index int) {
+		// each copy decodes into its own response, so copies cannot overwrite each other's data
+		copyResponse := aurestresponsecopy.NewLike(response)
+		go func() {
+			start := time.Now()
+			err := c.Wrapped.Perform(hedgeCtx, method, requestUrl, requestBody, copyResponse)
+			results <- copyResult{index: index, response: copyResponse, err: err, latency: time.Since(start)}
+		}()
+	}
+
+	sent := 1
+	running := 1
+	sendCopy(0)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case result := <-results:
+			running--
+			if result.successful() {
+				c.latencies.add(result.latency)
+				if result.index > 0 {
+					c.HedgeWonMetricsCallback(ctx, method, requestUrl, result.response.Status, nil, result.latency, 0)
+					aulogging.Logger.Ctx(ctx).Debug().Printf("downstream %s %s -> hedge %d won", method, aurestredaction.Use(c.Redactor).Url(requestUrl), result.index)
+				}
+				aurestresponsecopy.CopyInto(response, result.response)
+				return result.err
+			}
+			if running == 0 {
+				// nothing else in flight - hedging is not retrying, that is left to aurestretry
+				aurestresponsecopy.CopyInto(response, result.response)
+				return result.err
+			}
+		case <-timer.C:
+			if sent < maxCopies {
+				c.HedgeSentMetricsCallback(ctx, method, requestUrl, 0, nil, delay, 0)
+				sendCopy(sent)
+				sent++
+				running++
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
+func (c *HedgingImpl) currentDelay() time.Duration {
+	if c.DelayPercentile > 0 && c.DelayPercentile < 1 {
+		if observed, ok := c.latencies.percentile(c.DelayPercentile, c.MinSamples); ok {
+			return observed
+		}
+	}
+	return c.Delay
+}
+
+// latencyWindow keeps the most recent latencies of successful requests.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+func (w *latencyWindow) percentile(p float64, minSamples int) (time.Duration, bool) {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+	if len(sorted) == 0 || len(sorted) < minSamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))], true
+}
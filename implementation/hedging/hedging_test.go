@@ -0,0 +1,155 @@
+package auresthedging
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tstDto struct {
+	Copy int `json:"copy"`
+}
+
+// latencyClient answers each call after the latency configured for its call number (counting from 0),
+// or fails if the context is cancelled before
+type latencyClient struct {
+	mu        sync.Mutex
+	calls     int
+	latencies []time.Duration
+	errs      []error
+	cancelled int
+}
+
+func (c *latencyClient) Perform(ctx context.Context, _ string, _ string, _ interface{}, response *aurestclientapi.ParsedResponse) error {
+	c.mu.Lock()
+	call := c.calls
+	c.calls++
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.cancelled++
+		c.mu.Unlock()
+		return ctx.Err()
+	case <-time.After(c.latencies[call]):
+	}
+	if c.errs != nil && c.errs[call] != nil {
+		return c.errs[call]
+	}
+	response.Status = 200
+	response.Body.(*tstDto).Copy = call
+	return nil
+}
+
+func (c *latencyClient) callCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func TestFastResponseNoHedge(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &latencyClient{latencies: []time.Duration{0, 0}}
+	cut := New(mock, 200*time.Millisecond)
+
+	dto := tstDto{Copy: -1}
+	err := cut.Perform(context.Background(), "GET", "http://replicated", nil, &aurestclientapi.ParsedResponse{Body: &dto})
+	require.Nil(t, err)
+	require.Equal(t, 0, dto.Copy)
+	require.Equal(t, 1, mock.callCount())
+}
+
+func TestSlowResponseIsHedged(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	sent, won := 0, 0
+	mock := &latencyClient{latencies: []time.Duration{5 * time.Second, 0}}
+	cut := New(mock, 20*time.Millisecond)
+	Instrument(cut,
+		func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+			sent++
+		},
+		func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+			won++
+		},
+	)
+
+	dto := tstDto{Copy: -1}
+	start := time.Now()
+	err := cut.Perform(context.Background(), "GET", "http://replicated", nil, &aurestclientapi.ParsedResponse{Body: &dto})
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < time.Second)
+	require.Equal(t, 1, dto.Copy)
+	require.Equal(t, 1, sent)
+	require.Equal(t, 1, won)
+
+	// the slow copy gets cancelled
+	require.Eventually(t, func() bool {
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		return mock.cancelled == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestFastFailureIsNotHedged(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &latencyClient{
+		latencies: []time.Duration{0, 0},
+		errs:      []error{errors.New("some transport error"), nil},
+	}
+	cut := New(mock, time.Hour)
+
+	err := cut.Perform(context.Background(), "GET", "http://replicated", nil, &aurestclientapi.ParsedResponse{Body: &tstDto{}})
+	require.NotNil(t, err)
+	require.Equal(t, "some transport error", err.Error())
+	require.Equal(t, 1, mock.callCount())
+}
+
+func TestAllCopiesFail(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &latencyClient{
+		latencies: []time.Duration{200 * time.Millisecond, 200 * time.Millisecond, 200 * time.Millisecond},
+		errs:      []error{errors.New("first"), errors.New("second"), errors.New("third")},
+	}
+	cut := NewWithOptions(mock, HedgingOptions{MaxHedges: 2, Delay: 20 * time.Millisecond})
+
+	err := cut.Perform(context.Background(), "GET", "http://replicated", nil, &aurestclientapi.ParsedResponse{Body: &tstDto{}})
+	require.NotNil(t, err)
+	require.Equal(t, "third", err.Error())
+	require.Equal(t, 3, mock.callCount())
+}
+
+func TestPostIsNotHedged(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &latencyClient{
+		latencies: []time.Duration{0, 0},
+		errs:      []error{errors.New("some transport error"), nil},
+	}
+	cut := New(mock, time.Millisecond)
+
+	err := cut.Perform(context.Background(), "POST", "http://replicated", nil, &aurestclientapi.ParsedResponse{Body: &tstDto{}})
+	require.NotNil(t, err)
+	require.Equal(t, 1, mock.callCount())
+}
+
+func TestPercentileDelay(t *testing.T) {
+	w := &latencyWindow{}
+	_, ok := w.percentile(0.9, 5)
+	require.False(t, ok)
+	for i := 1; i <= 10; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	p, ok := w.percentile(0.9, 5)
+	require.True(t, ok)
+	require.Equal(t, 9*time.Millisecond, p)
+}
@@ -107,6 +107,8 @@ func (c *HttpClientImpl) Perform(ctx context.Context, method string, requestUrl
 		req.Header.Set(headers.ContentType, contentType)
 	}
 
+	applyContextHeaders(req)
+
 	if c.RequestManipulator != nil {
 		c.RequestManipulator(ctx, req)
 	}
@@ -119,9 +121,9 @@ func (c *HttpClientImpl) Perform(ctx context.Context, method string, requestUrl
 	if err != nil {
 		switch err.(type) {
 		case *url.Error:
-			return fmt.Errorf("url.Error received on http request: %s", err.Error())
+			return fmt.Errorf("url.Error received on http request: %w", err)
 		default:
-			return fmt.Errorf("unexpected http error received: %s", err.Error())
+			return fmt.Errorf("unexpected http error received: %w", err)
 		}
 	}
 
@@ -160,6 +162,14 @@ func (c *HttpClientImpl) Perform(ctx context.Context, method string, requestUrl
 	return nil
 }
 
+// applyContextHeaders sets headers that layers further up in the stack requested using
+// aurestclientapi.ContextWithRequestHeader.
+func applyContextHeaders(req *http.Request) {
+	for name, values := range aurestclientapi.RequestHeadersFromContext(req.Context()) {
+		req.Header[name] = append([]string(nil), values...)
+	}
+}
+
 func (c *HttpClientImpl) requestBodyReader(requestBody interface{}) (io.Reader, int, string, error) {
 	if requestBody == nil {
 		return nil, 0, "", nil
@@ -46,6 +46,12 @@ type HttpClientRoundTripper struct {
 }
 
 func (c *HttpClientRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(aurestclientapi.RequestHeadersFromContext(req.Context())) > 0 {
+		// a RoundTripper must not modify the original request
+		req = req.Clone(req.Context())
+		applyContextHeaders(req)
+	}
+
 	if c.RequestManipulator != nil {
 		c.RequestManipulator(req.Context(), req)
 	}
@@ -0,0 +1,85 @@
+package aurestidempotency
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"net/http"
+	"strings"
+)
+
+const DefaultHeaderName = "Idempotency-Key"
+
+// KeyGeneratorFunction creates a new idempotency key for a logical request.
+type KeyGeneratorFunction func(ctx context.Context, method string, requestUrl string) string
+
+type IdempotencyOptions struct {
+	// HeaderName defaults to DefaultHeaderName
+	HeaderName string
+	// Methods that get an idempotency key, defaults to POST and PATCH
+	Methods []string
+	// KeyGeneratorOrNil defaults to random UUIDs
+	KeyGeneratorOrNil KeyGeneratorFunction
+}
+
+type IdempotencyImpl struct {
+	Wrapped aurestclientapi.Client
+
+	HeaderName   string
+	Methods      map[string]struct{}
+	KeyGenerator KeyGeneratorFunction
+}
+
+// New builds a layer that adds an Idempotency-Key header to POST and PATCH requests.
+//
+// Insert this into your stack above the retry, so all attempts of a logical request send the same key,
+// and the downstream can recognize the retries.
+//
+// If the context already contains the header (see aurestclientapi.ContextWithRequestHeader), it is left alone, so
+// you can supply your own key for individual requests.
+func New(wrapped aurestclientapi.Client) aurestclientapi.Client {
+	return NewWithOptions(wrapped, IdempotencyOptions{})
+}
+
+// NewWithOptions builds an idempotency key layer with custom header name, methods, or key generator.
+func NewWithOptions(wrapped aurestclientapi.Client, opts IdempotencyOptions) aurestclientapi.Client {
+	instance := &IdempotencyImpl{
+		Wrapped:      wrapped,
+		HeaderName:   DefaultHeaderName,
+		Methods:      map[string]struct{}{},
+		KeyGenerator: RandomUUIDKeyGenerator,
+	}
+	if opts.HeaderName != "" {
+		instance.HeaderName = opts.HeaderName
+	}
+	methods := opts.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	for _, m := range methods {
+		instance.Methods[strings.ToUpper(m)] = struct{}{}
+	}
+	if opts.KeyGeneratorOrNil != nil {
+		instance.KeyGenerator = opts.KeyGeneratorOrNil
+	}
+	return instance
+}
+
+func (c *IdempotencyImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	if _, ok := c.Methods[strings.ToUpper(method)]; ok {
+		if aurestclientapi.RequestHeadersFromContext(ctx).Get(c.HeaderName) == "" {
+			ctx = aurestclientapi.ContextWithRequestHeader(ctx, c.HeaderName, c.KeyGenerator(ctx, method, requestUrl))
+		}
+	}
+	return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+}
+
+// RandomUUIDKeyGenerator generates a random (version 4) UUID.
+func RandomUUIDKeyGenerator(_ context.Context, _ string, _ string) string {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
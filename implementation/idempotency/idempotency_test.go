@@ -0,0 +1,80 @@
+package aurestidempotency
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestretry "github.com/StephanHCB/go-autumn-restclient/implementation/retry"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// headerRecordingClient records the requested header from the context and always fails
+type headerRecordingClient struct {
+	headerName string
+	seen       []string
+}
+
+func (c *headerRecordingClient) Perform(ctx context.Context, _ string, _ string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	c.seen = append(c.seen, aurestclientapi.RequestHeadersFromContext(ctx).Get(c.headerName))
+	return errors.New("some transport error")
+}
+
+func tstStack(recorder aurestclientapi.Client, opts IdempotencyOptions) aurestclientapi.Client {
+	retrying := aurestretry.NewWithOptions(recorder,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			return true
+		},
+		aurestretry.RetryOptions{
+			RepeatCount:     2,
+			SilenceGivingUp: true,
+		},
+	)
+	return NewWithOptions(retrying, opts)
+}
+
+func TestSameKeyForAllAttempts(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &headerRecordingClient{headerName: DefaultHeaderName}
+	cut := tstStack(recorder, IdempotencyOptions{})
+
+	_ = cut.Perform(context.Background(), "POST", "http://pay", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, 3, len(recorder.seen))
+	require.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", recorder.seen[0])
+	require.Equal(t, recorder.seen[0], recorder.seen[1])
+	require.Equal(t, recorder.seen[0], recorder.seen[2])
+
+	// a new logical request gets a new key
+	_ = cut.Perform(context.Background(), "POST", "http://pay", nil, &aurestclientapi.ParsedResponse{})
+	require.NotEqual(t, recorder.seen[0], recorder.seen[3])
+}
+
+func TestOnlyConfiguredMethods(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &headerRecordingClient{headerName: "X-Request-Key"}
+	cut := tstStack(recorder, IdempotencyOptions{
+		HeaderName: "X-Request-Key",
+		Methods:    []string{"put"},
+		KeyGeneratorOrNil: func(ctx context.Context, method string, requestUrl string) string {
+			return "fixed"
+		},
+	})
+
+	_ = cut.Perform(context.Background(), "POST", "http://pay", nil, &aurestclientapi.ParsedResponse{})
+	_ = cut.Perform(context.Background(), "PUT", "http://pay", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, []string{"", "", "", "fixed", "fixed", "fixed"}, recorder.seen)
+}
+
+func TestCallerSuppliedKeyIsKept(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &headerRecordingClient{headerName: DefaultHeaderName}
+	cut := New(recorder)
+
+	ctx := aurestclientapi.ContextWithRequestHeader(context.Background(), DefaultHeaderName, "mine")
+	_ = cut.Perform(ctx, "POST", "http://pay", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, []string{"mine"}, recorder.seen)
+}
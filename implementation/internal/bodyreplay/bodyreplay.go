@@ -0,0 +1,102 @@
+package aurestbodyreplay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"io"
+)
+
+// DefaultMaxBufferedSize is the default limit for buffering a request body in memory.
+const DefaultMaxBufferedSize = 1024 * 1024
+
+// ErrNotReplayable is wrapped into the (non-tripping) error returned when a request would need to be sent again,
+// but the custom request body cannot be replayed.
+var ErrNotReplayable = errors.New("request body cannot be replayed")
+
+// Replayer provides the request body for each attempt, so that a custom request body whose reader
+// was consumed by a previous attempt is sent in full again.
+type Replayer struct {
+	original aurestclientapi.CustomRequestBody
+
+	seeker     io.Seeker
+	seekOffset int64
+
+	buffered []byte
+	// notReplayable is set if the body could not be buffered, the reason is kept for the error message
+	notReplayable error
+}
+
+// New prepares the request body for replay. It returns nil if the body needs no special treatment.
+//
+// The order of preference is GetBody, io.Seeker, and finally buffering in memory up to maxBuffered bytes.
+// A negative maxBuffered disables buffering.
+func New(ctx context.Context, requestBody interface{}, maxBuffered int) (*Replayer, error) {
+	custom, ok := requestBody.(aurestclientapi.CustomRequestBody)
+	if !ok || custom.BodyReader == nil {
+		return nil, nil
+	}
+
+	r := &Replayer{
+		original: custom,
+	}
+	if custom.GetBody != nil {
+		return r, nil
+	}
+	if seeker, ok := custom.BodyReader.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			r.seeker = seeker
+			r.seekOffset = offset
+			return r, nil
+		}
+	}
+	if maxBuffered < 0 || custom.BodyLength > maxBuffered {
+		r.notReplayable = fmt.Errorf("body of length %d exceeds maximum buffer size %d", custom.BodyLength, maxBuffered)
+		return r, nil
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(custom.BodyReader, int64(maxBuffered)+1))
+	if err != nil {
+		return nil, aurestnontripping.New(ctx, fmt.Errorf("failed to buffer request body for replay: %w", err))
+	}
+	if len(buffered) > maxBuffered {
+		// too large - the first attempt still gets the complete body, but we cannot replay it
+		r.original.BodyReader = io.MultiReader(bytes.NewReader(buffered), custom.BodyReader)
+		r.notReplayable = fmt.Errorf("body exceeds maximum buffer size %d", maxBuffered)
+		return r, nil
+	}
+	r.buffered = buffered
+	return r, nil
+}
+
+// BodyFor returns the request body to send for the given attempt (counting from 1).
+func (r *Replayer) BodyFor(ctx context.Context, attempt int) (interface{}, error) {
+	body := r.original
+	if r.buffered != nil {
+		body.BodyReader = bytes.NewReader(r.buffered)
+		return body, nil
+	}
+	if attempt == 1 {
+		return body, nil
+	}
+
+	if r.original.GetBody != nil {
+		reader, err := r.original.GetBody()
+		if err != nil {
+			return nil, aurestnontripping.New(ctx, fmt.Errorf("%w: GetBody failed: %s", ErrNotReplayable, err.Error()))
+		}
+		body.BodyReader = reader
+		return body, nil
+	}
+	if r.seeker != nil {
+		if _, err := r.seeker.Seek(r.seekOffset, io.SeekStart); err != nil {
+			return nil, aurestnontripping.New(ctx, fmt.Errorf("%w: seek failed: %s", ErrNotReplayable, err.Error()))
+		}
+		return body, nil
+	}
+	return nil, aurestnontripping.New(ctx, fmt.Errorf("%w: %s", ErrNotReplayable, r.notReplayable.Error()))
+}
@@ -0,0 +1,19 @@
+package aurestdetachedcontext
+
+import "context"
+
+// detachedContext keeps the values of its parent, but not its deadline or cancellation.
+type detachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+// Detach returns a context that keeps the values of ctx (for logging, tracing etc.), but is not
+// cancelled when ctx is.
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{Context: context.Background(), parent: ctx}
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
@@ -0,0 +1,110 @@
+package aurestresponsecopy
+
+import (
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"reflect"
+)
+
+// NewLike returns an empty response whose Body is a copy of the value the Body of template points to,
+// so a request can decode into it without touching the data of template, while keeping any defaults
+// the caller filled in.
+//
+// If template has no Body, the new response has no Body either. A Body that is not a pointer is passed on
+// unchanged, as it cannot be decoded into anyway.
+func NewLike(template *aurestclientapi.ParsedResponse) *aurestclientapi.ParsedResponse {
+	return &aurestclientapi.ParsedResponse{
+		Body: NewBodyLike(template.Body),
+	}
+}
+
+// NewBodyLike allocates a new value of the type body points to, and fills it with a deep copy of that value.
+//
+// Returns body itself if it is not a pointer.
+func NewBodyLike(body interface{}) interface{} {
+	if body == nil {
+		return nil
+	}
+	original := reflect.ValueOf(body)
+	if original.Kind() != reflect.Ptr {
+		return body
+	}
+	copied := reflect.New(original.Type().Elem())
+	if !original.IsNil() {
+		copied.Elem().Set(deepCopy(original.Elem()))
+	}
+	return copied.Interface()
+}
+
+// deepCopy copies maps, slices and pointers, so decoding into the copy cannot modify the original.
+//
+// Unexported struct fields are copied shallowly, json decoding never touches them.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type().Elem())
+		copied.Elem().Set(deepCopy(v.Elem()))
+		return copied
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(deepCopy(v.Elem()))
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			copied.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return copied
+	case reflect.Array:
+		copied := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return copied
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if copied.Field(i).CanSet() {
+				copied.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// CopyInto transfers the result held in src into dst, including the value its Body points to.
+//
+// src must have been created by NewLike(dst).
+func CopyInto(dst *aurestclientapi.ParsedResponse, src *aurestclientapi.ParsedResponse) {
+	dst.Status = src.Status
+	dst.Header = src.Header
+	dst.Time = src.Time
+	if dst.Body != nil && src.Body != nil {
+		dstValue := reflect.ValueOf(dst.Body)
+		srcValue := reflect.ValueOf(src.Body)
+		if dstValue.Kind() == reflect.Ptr && !dstValue.IsNil() && srcValue.Type() == dstValue.Type() && !srcValue.IsNil() {
+			dstValue.Elem().Set(srcValue.Elem())
+		}
+	}
+}
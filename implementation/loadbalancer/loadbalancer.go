@@ -0,0 +1,376 @@
+package aurestloadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestbodyreplay "github.com/StephanHCB/go-autumn-restclient/implementation/internal/bodyreplay"
+	aurestresponsecopy "github.com/StephanHCB/go-autumn-restclient/implementation/internal/responsecopy"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type Strategy int
+
+const (
+	// RoundRobin uses the endpoints in turn.
+	RoundRobin Strategy = iota
+	// LeastInFlight uses the endpoint with the fewest requests in flight, in turn among equals.
+	LeastInFlight
+	// Weighted uses the endpoints in proportion to their weight, interleaving them smoothly.
+	Weighted
+)
+
+type Endpoint struct {
+	// BaseUrl provides the scheme and host (including port) that replace those of the request url,
+	// e.g. https://eu.example.com
+	BaseUrl string
+	// Weight is only used by the Weighted strategy, defaults to 1.
+	Weight int
+}
+
+// FailureConditionCallback decides whether the outcome of a request counts as a failure of the endpoint.
+type FailureConditionCallback func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool
+
+// FailoverConditionCallback decides whether a failed request may be sent again to another endpoint.
+type FailoverConditionCallback func(ctx context.Context, method string, requestUrl string, requestBody interface{}) bool
+
+type LoadBalancerOptions struct {
+	Endpoints []Endpoint
+	Strategy  Strategy
+
+	// ConsecutiveFailures ejects an endpoint after this many failures in a row, defaults to 3.
+	ConsecutiveFailures int
+	// EjectionTime is how long an ejected endpoint is skipped, defaults to 30 seconds.
+	EjectionTime time.Duration
+
+	// MaxFailovers limits how many other endpoints a failed request is sent to. Defaults to trying
+	// every endpoint once. Set to a negative value to disable failover.
+	MaxFailovers int
+
+	// FailureConditionOrNil determines what counts as a failure. Defaults to DefaultFailureCondition.
+	FailureConditionOrNil FailureConditionCallback
+	// FailoverConditionOrNil determines which requests may fail over. Defaults to DefaultFailoverCondition.
+	FailoverConditionOrNil FailoverConditionCallback
+
+	// MaxBufferedBodySize limits how many bytes of an aurestclientapi.CustomRequestBody are buffered in memory
+	// so the body can be sent again on failover. Only used if the BodyReader is not an io.Seeker and there is
+	// no GetBody function.
+	//
+	// 0 means DefaultMaxBufferedBodySize, a negative value disables buffering.
+	MaxBufferedBodySize int
+
+	// RedactorOrNil masks secrets in urls in log messages. Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
+}
+
+// DefaultMaxBufferedBodySize is the default for LoadBalancerOptions.MaxBufferedBodySize.
+const DefaultMaxBufferedBodySize = aurestbodyreplay.DefaultMaxBufferedSize
+
+// ErrBodyNotReplayable is wrapped into the (non-tripping) error returned when a failover would be needed,
+// but the custom request body cannot be sent again. It is the same error as aurestretry.ErrBodyNotReplayable.
+var ErrBodyNotReplayable = aurestbodyreplay.ErrNotReplayable
+
+type LoadBalancerImpl struct {
+	Wrapped aurestclientapi.Client
+
+	Strategy            Strategy
+	ConsecutiveFailures int
+	EjectionTime        time.Duration
+	MaxFailovers        int
+	FailureCondition    FailureConditionCallback
+	FailoverCondition   FailoverConditionCallback
+	MaxBufferedBodySize int
+
+	EjectedMetricsCallback  aurestclientapi.MetricsCallbackFunction
+	FailoverMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	// Redactor masks secrets in urls in log messages. nil uses aurestredaction.Default().
+	Redactor *aurestredaction.Redactor
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+
+	mu        sync.Mutex
+	endpoints []*endpointState
+	next      int
+}
+
+type endpointState struct {
+	scheme string
+	host   string
+	weight int
+
+	inFlight      int
+	consecutive   int
+	ejectedUntil  time.Time
+	currentWeight int
+}
+
+// DefaultFailureCondition counts errors (except non-tripping errors and cancellation by the caller)
+// and 5xx responses as failures.
+func DefaultFailureCondition(_ context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+	if err != nil {
+		return !aurestnontripping.Is(err) && !errors.Is(err, context.Canceled)
+	}
+	return response != nil && response.Status >= 500
+}
+
+// DefaultFailoverCondition allows failover for idempotent methods.
+//
+// A custom request body is sent again using its GetBody function, by seeking back if its reader is an io.Seeker,
+// or from an in-memory buffer (see LoadBalancerOptions.MaxBufferedBodySize). If none of these is possible,
+// failover ends with a non-tripping error wrapping ErrBodyNotReplayable.
+func DefaultFailoverCondition(_ context.Context, method string, _ string, _ interface{}) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// New builds a round-robin load balancer over the given base urls.
+//
+// Insert this into your stack below the retry and above the request logging, so the log shows the actual
+// endpoint used.
+func New(wrapped aurestclientapi.Client, baseUrls ...string) (aurestclientapi.Client, error) {
+	endpoints := make([]Endpoint, 0, len(baseUrls))
+	for _, baseUrl := range baseUrls {
+		endpoints = append(endpoints, Endpoint{BaseUrl: baseUrl})
+	}
+	return NewWithOptions(wrapped, LoadBalancerOptions{
+		Endpoints: endpoints,
+	})
+}
+
+// NewWithOptions builds a load balancer with more control, see LoadBalancerOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts LoadBalancerOptions) (aurestclientapi.Client, error) {
+	if len(opts.Endpoints) == 0 {
+		return nil, errors.New("load balancer needs at least one endpoint")
+	}
+
+	instance := &LoadBalancerImpl{
+		Wrapped:                 wrapped,
+		Strategy:                opts.Strategy,
+		ConsecutiveFailures:     3,
+		EjectionTime:            30 * time.Second,
+		MaxFailovers:            len(opts.Endpoints) - 1,
+		MaxBufferedBodySize:     DefaultMaxBufferedBodySize,
+		Redactor:                opts.RedactorOrNil,
+		FailureCondition:        DefaultFailureCondition,
+		FailoverCondition:       DefaultFailoverCondition,
+		EjectedMetricsCallback:  doNothingMetricsCallback,
+		FailoverMetricsCallback: doNothingMetricsCallback,
+		Now:                     time.Now,
+	}
+	for _, endpoint := range opts.Endpoints {
+		parsed, err := url.Parse(endpoint.BaseUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint base url %s: %w", endpoint.BaseUrl, err)
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint base url %s: needs scheme and host", endpoint.BaseUrl)
+		}
+		weight := endpoint.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		instance.endpoints = append(instance.endpoints, &endpointState{
+			scheme: parsed.Scheme,
+			host:   parsed.Host,
+			weight: weight,
+		})
+	}
+	if opts.ConsecutiveFailures > 0 {
+		instance.ConsecutiveFailures = opts.ConsecutiveFailures
+	}
+	if opts.EjectionTime > 0 {
+		instance.EjectionTime = opts.EjectionTime
+	}
+	if opts.MaxFailovers != 0 {
+		instance.MaxFailovers = opts.MaxFailovers
+	}
+	if opts.MaxBufferedBodySize != 0 {
+		instance.MaxBufferedBodySize = opts.MaxBufferedBodySize
+	}
+	if opts.FailureConditionOrNil != nil {
+		instance.FailureCondition = opts.FailureConditionOrNil
+	}
+	if opts.FailoverConditionOrNil != nil {
+		instance.FailoverCondition = opts.FailoverConditionOrNil
+	}
+	return instance, nil
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// ejectedMetricsCallback is called when an endpoint is ejected, with the url of the request that failed last.
+// failoverMetricsCallback is called when a request is sent to another endpoint, with the new url.
+//
+// Either of the callbacks may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	ejectedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+	failoverMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	lbClient, ok := client.(*LoadBalancerImpl)
+	if !ok {
+		return
+	}
+
+	if ejectedMetricsCallback != nil {
+		lbClient.EjectedMetricsCallback = ejectedMetricsCallback
+	}
+	if failoverMetricsCallback != nil {
+		lbClient.FailoverMetricsCallback = failoverMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func (c *LoadBalancerImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	parsedUrl, err := url.Parse(requestUrl)
+	if err != nil {
+		return aurestnontripping.New(ctx, fmt.Errorf("invalid request url: %w", err))
+	}
+
+	maxFailovers := 0
+	if c.MaxFailovers > 0 && c.FailoverCondition(ctx, method, requestUrl, requestBody) {
+		maxFailovers = c.MaxFailovers
+	}
+
+	var replayer *aurestbodyreplay.Replayer
+	if maxFailovers > 0 {
+		if replayer, err = aurestbodyreplay.New(ctx, requestBody, c.MaxBufferedBodySize); err != nil {
+			return err
+		}
+	}
+
+	tried := make(map[*endpointState]struct{})
+	for failover := 0; ; failover++ {
+		body := requestBody
+		if replayer != nil {
+			if body, err = replayer.BodyFor(ctx, failover+1); err != nil {
+				return err
+			}
+		}
+
+		endpoint := c.pick(tried)
+		tried[endpoint] = struct{}{}
+		endpointUrl := endpoint.rewrite(parsedUrl)
+
+		attemptResponse := response
+		if maxFailovers > 0 {
+			attemptResponse = aurestresponsecopy.NewLike(response)
+		}
+		if failover > 0 {
+			c.FailoverMetricsCallback(ctx, method, endpointUrl, 0, nil, 0, 0)
+			aulogging.Logger.Ctx(ctx).Info().Printf("failing over %s %s to %s", method, aurestredaction.Use(c.Redactor).Url(requestUrl), endpoint.host)
+		}
+
+		err = c.Wrapped.Perform(ctx, method, endpointUrl, body, attemptResponse)
+
+		failed := c.FailureCondition(ctx, attemptResponse, err)
+		c.release(ctx, endpoint, failed, method, endpointUrl, attemptResponse, err)
+
+		if !failed || failover >= maxFailovers || len(tried) >= len(c.endpoints) || ctx.Err() != nil {
+			if attemptResponse != response {
+				aurestresponsecopy.CopyInto(response, attemptResponse)
+			}
+			return err
+		}
+	}
+}
+
+func (e *endpointState) rewrite(parsedUrl *url.URL) string {
+	rewritten := *parsedUrl
+	rewritten.Scheme = e.scheme
+	rewritten.Host = e.host
+	return rewritten.String()
+}
+
+// pick selects the endpoint for the next request according to the strategy, skipping endpoints that are
+// ejected or were already tried. If all endpoints are ejected, ejection is ignored, because sending
+// requests to an endpoint that may be down is better than sending none at all.
+func (c *LoadBalancerImpl) pick(tried map[*endpointState]struct{}) *endpointState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Now()
+	candidates := make([]*endpointState, 0, len(c.endpoints))
+	for _, e := range c.endpoints {
+		if _, ok := tried[e]; !ok && !now.Before(e.ejectedUntil) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, e := range c.endpoints {
+			if _, ok := tried[e]; !ok {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = c.endpoints
+	}
+
+	var chosen *endpointState
+	switch c.Strategy {
+	case LeastInFlight:
+		offset := c.next
+		c.next++
+		for i := range candidates {
+			e := candidates[(offset+i)%len(candidates)]
+			if chosen == nil || e.inFlight < chosen.inFlight {
+				chosen = e
+			}
+		}
+	case Weighted:
+		// smooth weighted round-robin, as used by nginx
+		total := 0
+		for _, e := range candidates {
+			e.currentWeight += e.weight
+			total += e.weight
+			if chosen == nil || e.currentWeight > chosen.currentWeight {
+				chosen = e
+			}
+		}
+		chosen.currentWeight -= total
+	default:
+		chosen = candidates[c.next%len(candidates)]
+		c.next++
+	}
+	chosen.inFlight++
+	return chosen
+}
+
+func (c *LoadBalancerImpl) release(ctx context.Context, endpoint *endpointState, failed bool, method string, endpointUrl string, response *aurestclientapi.ParsedResponse, err error) {
+	c.mu.Lock()
+	endpoint.inFlight--
+	ejected := false
+	if failed {
+		endpoint.consecutive++
+		if endpoint.consecutive >= c.ConsecutiveFailures {
+			endpoint.consecutive = 0
+			endpoint.ejectedUntil = c.Now().Add(c.EjectionTime)
+			ejected = true
+		}
+	} else {
+		endpoint.consecutive = 0
+	}
+	c.mu.Unlock()
+
+	if ejected {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("ejecting endpoint %s for %s after %d consecutive failures", endpoint.host, c.EjectionTime, c.ConsecutiveFailures)
+		c.EjectedMetricsCallback(ctx, method, endpointUrl, response.Status, err, 0, 0)
+	}
+}
@@ -0,0 +1,266 @@
+package aurestloadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tstBody struct {
+	Region string `json:"region"`
+}
+
+func tstMock() aurestclientapi.Client {
+	mockClient := aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET https://eu.example.com/items?x=1 <nil>": {
+				Status: 200,
+				Body:   tstBody{Region: "eu"},
+			},
+			"GET https://us.example.com/items?x=1 <nil>": {
+				Status: 200,
+				Body:   tstBody{Region: "us"},
+			},
+			"GET http://ap.example.com:8080/items?x=1 <nil>": {
+				Status: 200,
+				Body:   tstBody{Region: "ap"},
+			},
+			"GET https://us.example.com/broken <nil>": {
+				Status: 502,
+				Body:   tstBody{Region: "us broken"},
+			},
+			"GET https://eu.example.com/broken <nil>": {
+				Status: 200,
+				Body:   tstBody{Region: "eu"},
+			},
+		},
+		map[string]error{
+			"GET https://eu.example.com/down <nil>":  errors.New("connection refused"),
+			"GET https://us.example.com/down <nil>":  errors.New("connection refused"),
+			"POST https://eu.example.com/down <nil>": errors.New("connection refused"),
+			"POST https://us.example.com/down <nil>": errors.New("connection refused"),
+		},
+	)
+	return aurestcapture.New(mockClient)
+}
+
+func tstPerform(cut aurestclientapi.Client, method string, requestUrl string) (*aurestclientapi.ParsedResponse, error) {
+	response := &aurestclientapi.ParsedResponse{Body: &tstBody{}}
+	err := cut.Perform(context.Background(), method, requestUrl, nil, response)
+	return response, err
+}
+
+func TestRoundRobin(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut, err := New(mock, "https://eu.example.com", "https://us.example.com", "http://ap.example.com:8080")
+	require.Nil(t, err)
+
+	regions := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		response, err := tstPerform(cut, "GET", "https://api.example.com/items?x=1")
+		require.Nil(t, err)
+		regions = append(regions, response.Body.(*tstBody).Region)
+	}
+	require.Equal(t, []string{"eu", "us", "ap", "eu"}, regions)
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	_, err := New(tstMock(), "eu.example.com")
+	require.NotNil(t, err)
+
+	_, err = New(tstMock())
+	require.NotNil(t, err)
+}
+
+func TestWeighted(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, err := NewWithOptions(tstMock(), LoadBalancerOptions{
+		Endpoints: []Endpoint{
+			{BaseUrl: "https://eu.example.com", Weight: 3},
+			{BaseUrl: "https://us.example.com"},
+		},
+		Strategy: Weighted,
+	})
+	require.Nil(t, err)
+
+	regions := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		response, err := tstPerform(cut, "GET", "https://api.example.com/items?x=1")
+		require.Nil(t, err)
+		regions = append(regions, response.Body.(*tstBody).Region)
+	}
+	require.Equal(t, []string{"eu", "eu", "us", "eu", "eu", "eu", "us", "eu"}, regions)
+}
+
+func TestLeastInFlight(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, err := NewWithOptions(tstMock(), LoadBalancerOptions{
+		Endpoints: []Endpoint{
+			{BaseUrl: "https://eu.example.com"},
+			{BaseUrl: "https://us.example.com"},
+		},
+		Strategy: LeastInFlight,
+	})
+	require.Nil(t, err)
+	lb := cut.(*LoadBalancerImpl)
+
+	// pretend eu is busy
+	lb.endpoints[0].inFlight = 5
+	for i := 0; i < 3; i++ {
+		response, err := tstPerform(cut, "GET", "https://api.example.com/items?x=1")
+		require.Nil(t, err)
+		require.Equal(t, "us", response.Body.(*tstBody).Region)
+	}
+}
+
+func TestFailoverAndEjection(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut, err := NewWithOptions(mock, LoadBalancerOptions{
+		Endpoints: []Endpoint{
+			{BaseUrl: "https://us.example.com"},
+			{BaseUrl: "https://eu.example.com"},
+		},
+		ConsecutiveFailures: 2,
+		EjectionTime:        10 * time.Second,
+	})
+	require.Nil(t, err)
+	lb := cut.(*LoadBalancerImpl)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	lb.Now = func() time.Time { return now }
+	ejected := make([]string, 0)
+	failedOver := make([]string, 0)
+	Instrument(cut, func(_ context.Context, _ string, requestUrl string, _ int, _ error, _ time.Duration, _ int) {
+		ejected = append(ejected, requestUrl)
+	}, func(_ context.Context, _ string, requestUrl string, _ int, _ error, _ time.Duration, _ int) {
+		failedOver = append(failedOver, requestUrl)
+	})
+
+	// us answers 502, so the request fails over to eu, and the caller only sees the eu response
+	response, err := tstPerform(cut, "GET", "https://api.example.com/broken")
+	require.Nil(t, err)
+	require.Equal(t, 200, response.Status)
+	require.Equal(t, "eu", response.Body.(*tstBody).Region)
+	require.Equal(t, []string{"https://eu.example.com/broken"}, failedOver)
+
+	// a POST is not idempotent, so no failover - and this second consecutive failure for us ejects it
+	aurestcapture.ResetRecording(mock)
+	_, err = tstPerform(cut, "POST", "https://api.example.com/down")
+	require.NotNil(t, err)
+	require.Equal(t, []string{"POST https://us.example.com/down <nil>"}, aurestcapture.GetRecording(mock))
+	require.Equal(t, []string{"https://us.example.com/down"}, ejected)
+
+	aurestcapture.ResetRecording(mock)
+	for i := 0; i < 3; i++ {
+		response, err = tstPerform(cut, "GET", "https://api.example.com/items?x=1")
+		require.Nil(t, err)
+		require.Equal(t, "eu", response.Body.(*tstBody).Region)
+	}
+
+	// timed re-admission
+	now = now.Add(10 * time.Second)
+	regions := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		response, err = tstPerform(cut, "GET", "https://api.example.com/items?x=1")
+		require.Nil(t, err)
+		regions = append(regions, response.Body.(*tstBody).Region)
+	}
+	require.ElementsMatch(t, []string{"eu", "us"}, regions)
+}
+
+func TestAllEndpointsFail(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut, err := New(mock, "https://eu.example.com", "https://us.example.com")
+	require.Nil(t, err)
+
+	_, err = tstPerform(cut, "GET", "https://api.example.com/down")
+	require.NotNil(t, err)
+	require.Equal(t, 2, len(aurestcapture.GetRecording(mock)))
+}
+
+func TestDefaultFailoverCondition(t *testing.T) {
+	ctx := context.Background()
+	require.True(t, DefaultFailoverCondition(ctx, "GET", "", nil))
+	require.True(t, DefaultFailoverCondition(ctx, "PUT", "", struct{}{}))
+	require.False(t, DefaultFailoverCondition(ctx, "POST", "", nil))
+	require.True(t, DefaultFailoverCondition(ctx, "PUT", "", aurestclientapi.CustomRequestBody{
+		BodyReader: &bytes.Buffer{},
+	}))
+}
+
+// bodyRecordingClient reads the complete request body on each attempt and always fails
+type bodyRecordingClient struct {
+	bodies []string
+}
+
+func (c *bodyRecordingClient) Perform(_ context.Context, _ string, _ string, requestBody interface{}, _ *aurestclientapi.ParsedResponse) error {
+	custom := requestBody.(aurestclientapi.CustomRequestBody)
+	contents, _ := io.ReadAll(custom.BodyReader)
+	c.bodies = append(c.bodies, string(contents))
+	return errors.New("connection refused")
+}
+
+// onlyReader hides all methods except Read, so the body can neither be seeked nor recognized as a buffer
+type onlyReader struct {
+	io.Reader
+}
+
+func TestFailoverReplaysBody(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	for name, reader := range map[string]io.Reader{
+		"seeker":   strings.NewReader("payload"),
+		"buffered": onlyReader{bytes.NewBufferString("payload")},
+	} {
+		recorder := &bodyRecordingClient{}
+		cut, err := New(recorder, "https://eu.example.com", "https://us.example.com")
+		require.Nil(t, err)
+
+		err = cut.Perform(context.Background(), "PUT", "https://api.example.com/items", aurestclientapi.CustomRequestBody{
+			BodyReader: reader,
+			BodyLength: 7,
+		}, &aurestclientapi.ParsedResponse{})
+		require.NotNil(t, err, name)
+		require.Equal(t, []string{"payload", "payload"}, recorder.bodies, name)
+	}
+}
+
+func TestFailoverBodyTooLargeToReplay(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &bodyRecordingClient{}
+	cut, err := NewWithOptions(recorder, LoadBalancerOptions{
+		Endpoints: []Endpoint{
+			{BaseUrl: "https://eu.example.com"},
+			{BaseUrl: "https://us.example.com"},
+		},
+		MaxBufferedBodySize: 4,
+	})
+	require.Nil(t, err)
+
+	err = cut.Perform(context.Background(), "PUT", "https://api.example.com/items", aurestclientapi.CustomRequestBody{
+		BodyReader: onlyReader{strings.NewReader("payload")},
+		BodyLength: -1,
+	}, &aurestclientapi.ParsedResponse{})
+	require.True(t, aurestnontripping.Is(err))
+	require.True(t, errors.Is(err, ErrBodyNotReplayable))
+	// the first attempt still got the complete body
+	require.Equal(t, []string{"payload"}, recorder.bodies)
+}
@@ -0,0 +1,392 @@
+package aurestratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRemainingHeaderName = "X-RateLimit-Remaining"
+	DefaultResetHeaderName     = "X-RateLimit-Reset"
+)
+
+// LimitKeyFunction determines which token bucket a request takes its token from.
+type LimitKeyFunction func(ctx context.Context, method string, requestUrl string, requestBody interface{}) string
+
+type RateLimitOptions struct {
+	// Rate is the number of requests per second. Required.
+	Rate float64
+	// Burst is the number of requests that may be made at once after a quiet period, defaults to 1.
+	Burst int
+
+	// LimitKeyOrNil determines the token bucket of a request. If nil, there is one global bucket.
+	// See also PerHost and PerRoute.
+	LimitKeyOrNil LimitKeyFunction
+
+	// FailFast rejects requests with a RateLimitedError instead of waiting for a token.
+	FailFast bool
+	// MaxWait limits how long a request waits for a token. If 0, it may wait until its context deadline.
+	//
+	// Requests that would have to wait beyond their context deadline are rejected right away.
+	MaxWait time.Duration
+
+	// AdaptFromHeaders lowers the rate while the downstream reports that its quota is running out,
+	// see RemainingHeaderName and ResetHeaderName.
+	AdaptFromHeaders bool
+	// RemainingHeaderName defaults to X-RateLimit-Remaining.
+	RemainingHeaderName string
+	// ResetHeaderName defaults to X-RateLimit-Reset. Its value may be either a number of seconds
+	// or a unix timestamp.
+	ResetHeaderName string
+}
+
+type RateLimitImpl struct {
+	Wrapped aurestclientapi.Client
+
+	Rate     float64
+	Burst    int
+	LimitKey LimitKeyFunction
+	FailFast bool
+	MaxWait  time.Duration
+
+	AdaptFromHeaders    bool
+	RemainingHeaderName string
+	ResetHeaderName     string
+
+	WaitMetricsCallback     aurestclientapi.MetricsCallbackFunction
+	RejectedMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+	// Sleep is exposed so tests can avoid actually waiting by overwriting this field
+	Sleep func(ctx context.Context, duration time.Duration) error
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	// adaptedRate applies instead of the configured rate until adaptedUntil
+	adaptedRate  float64
+	adaptedUntil time.Time
+}
+
+const sweepInterval = time.Minute
+
+// RateLimitedError is returned without making the request when no token is available and the request
+// may not wait long enough for one.
+//
+// It is a non-tripping error, so circuit breakers further up do not count it.
+type RateLimitedError struct {
+	ctx context.Context
+	Key string
+	// Wait is how long the request would have had to wait for a token.
+	Wait time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for '%s', next token in %s", e.Key, e.Wait)
+}
+
+// implement NonTrippingError
+
+func (e *RateLimitedError) Ctx() context.Context {
+	return e.ctx
+}
+
+func (e *RateLimitedError) IsNonTrippingError() bool {
+	return true
+}
+
+// IsRateLimited checks whether err is (or wraps) a *RateLimitedError.
+func IsRateLimited(err error) bool {
+	var rateLimitedError *RateLimitedError
+	return errors.As(err, &rateLimitedError)
+}
+
+// PerHost is a LimitKeyFunction with a separate token bucket for each host.
+func PerHost(_ context.Context, _ string, requestUrl string, _ interface{}) string {
+	parsed, err := url.Parse(requestUrl)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// PerRoute is a LimitKeyFunction with a separate token bucket for each method, host and path. The query is ignored.
+func PerRoute(_ context.Context, method string, requestUrl string, _ interface{}) string {
+	parsed, err := url.Parse(requestUrl)
+	if err != nil {
+		return method + " " + requestUrl
+	}
+	return method + " " + parsed.Host + parsed.EscapedPath()
+}
+
+// New builds a rate limiter that allows rate requests per second with the given burst, and makes
+// requests wait for a token as long as their context deadline permits.
+//
+// Insert this into your stack below the retry, so each retry also takes a token.
+func New(wrapped aurestclientapi.Client, rate float64, burst int) aurestclientapi.Client {
+	return NewWithOptions(wrapped, RateLimitOptions{
+		Rate:  rate,
+		Burst: burst,
+	})
+}
+
+// NewWithOptions builds a rate limiter with more control, see RateLimitOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts RateLimitOptions) aurestclientapi.Client {
+	instance := &RateLimitImpl{
+		Wrapped:                 wrapped,
+		Rate:                    opts.Rate,
+		Burst:                   1,
+		LimitKey:                globalKey,
+		FailFast:                opts.FailFast,
+		MaxWait:                 opts.MaxWait,
+		AdaptFromHeaders:        opts.AdaptFromHeaders,
+		RemainingHeaderName:     DefaultRemainingHeaderName,
+		ResetHeaderName:         DefaultResetHeaderName,
+		WaitMetricsCallback:     doNothingMetricsCallback,
+		RejectedMetricsCallback: doNothingMetricsCallback,
+		Now:                     time.Now,
+		Sleep:                   contextSleep,
+		buckets:                 make(map[string]*bucket),
+	}
+	if opts.Burst > 0 {
+		instance.Burst = opts.Burst
+	}
+	if opts.LimitKeyOrNil != nil {
+		instance.LimitKey = opts.LimitKeyOrNil
+	}
+	if opts.RemainingHeaderName != "" {
+		instance.RemainingHeaderName = opts.RemainingHeaderName
+	}
+	if opts.ResetHeaderName != "" {
+		instance.ResetHeaderName = opts.ResetHeaderName
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// waitMetricsCallback is called for each request that had to wait for a token, with the wait time as latency.
+// rejectedMetricsCallback is called for each request that is rejected.
+//
+// Either of the callbacks may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	waitMetricsCallback aurestclientapi.MetricsCallbackFunction,
+	rejectedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	rateLimitClient, ok := client.(*RateLimitImpl)
+	if !ok {
+		return
+	}
+
+	if waitMetricsCallback != nil {
+		rateLimitClient.WaitMetricsCallback = waitMetricsCallback
+	}
+	if rejectedMetricsCallback != nil {
+		rateLimitClient.RejectedMetricsCallback = rejectedMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func globalKey(_ context.Context, _ string, _ string, _ interface{}) string {
+	return ""
+}
+
+func contextSleep(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *RateLimitImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	key := c.LimitKey(ctx, method, requestUrl, requestBody)
+
+	wait, err := c.reserve(ctx, key)
+	if err != nil {
+		c.RejectedMetricsCallback(ctx, method, requestUrl, 0, err, 0, 0)
+		return err
+	}
+	if wait > 0 {
+		if err := c.Sleep(ctx, wait); err != nil {
+			c.unreserve(key)
+			return err
+		}
+		c.WaitMetricsCallback(ctx, method, requestUrl, 0, nil, wait, 0)
+	}
+
+	err = c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+
+	if c.AdaptFromHeaders && response != nil && response.Header != nil {
+		c.adapt(key, response)
+	}
+	return err
+}
+
+// reserve takes a token from the bucket, possibly one that will only become available in the future,
+// and returns how long to wait for it.
+func (c *RateLimitImpl) reserve(ctx context.Context, key string) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Now()
+	c.sweep(now)
+	b := c.bucketFor(key, now)
+	b.refill(now, c.Rate, c.Burst)
+
+	wait := b.waitFor(now, 1, c.Rate)
+	if wait > 0 {
+		if c.FailFast || (c.MaxWait > 0 && wait > c.MaxWait) {
+			return 0, &RateLimitedError{ctx: ctx, Key: key, Wait: wait}
+		}
+		if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+			return 0, &RateLimitedError{ctx: ctx, Key: key, Wait: wait}
+		}
+	}
+	b.tokens--
+	return wait, nil
+}
+
+func (c *RateLimitImpl) unreserve(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.buckets[key]; ok {
+		b.tokens = math.Min(b.tokens+1, float64(c.Burst))
+	}
+}
+
+// adapt lowers the rate until the reset time so the remaining quota reported by the downstream is spread out.
+func (c *RateLimitImpl) adapt(key string, response *aurestclientapi.ParsedResponse) {
+	remaining, err := strconv.Atoi(response.Header.Get(c.RemainingHeaderName))
+	if err != nil || remaining < 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Now()
+	resetAt, ok := parseReset(response.Header.Get(c.ResetHeaderName), now)
+	if !ok || !resetAt.After(now) {
+		return
+	}
+
+	b := c.bucketFor(key, now)
+	b.refill(now, c.Rate, c.Burst)
+	b.tokens = math.Min(b.tokens, float64(remaining))
+	b.adaptedRate = math.Min(c.Rate, float64(remaining)/resetAt.Sub(now).Seconds())
+	b.adaptedUntil = resetAt
+}
+
+// parseReset accepts both a number of seconds and a unix timestamp, telling them apart by size.
+func parseReset(value string, now time.Time) (time.Time, bool) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	if seconds > 1e9 {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	return now.Add(time.Duration(seconds * float64(time.Second))), true
+}
+
+// bucketFor returns the bucket for key, creating a full one if needed.
+//
+// Must be called with the mutex held.
+func (c *RateLimitImpl) bucketFor(key string, now time.Time) *bucket {
+	b, ok := c.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(c.Burst), last: now}
+		c.buckets[key] = b
+	}
+	return b
+}
+
+// sweep drops buckets that have refilled completely, they are the same as new ones.
+//
+// Must be called with the mutex held.
+func (c *RateLimitImpl) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < sweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for key, b := range c.buckets {
+		b.refill(now, c.Rate, c.Burst)
+		if b.tokens >= float64(c.Burst) && b.adaptedUntil.IsZero() {
+			delete(c.buckets, key)
+		}
+	}
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	if !now.After(b.last) {
+		return
+	}
+	from := b.last
+	if !b.adaptedUntil.IsZero() {
+		if now.Before(b.adaptedUntil) {
+			b.add(b.adaptedRate*now.Sub(from).Seconds(), burst)
+			b.last = now
+			return
+		}
+		b.add(b.adaptedRate*b.adaptedUntil.Sub(from).Seconds(), burst)
+		from = b.adaptedUntil
+		b.adaptedUntil = time.Time{}
+	}
+	b.add(rate*now.Sub(from).Seconds(), burst)
+	b.last = now
+}
+
+func (b *bucket) add(tokens float64, burst int) {
+	b.tokens = math.Min(b.tokens+tokens, float64(burst))
+}
+
+// waitFor calculates how long it takes until the bucket holds the given number of tokens.
+func (b *bucket) waitFor(now time.Time, tokens float64, rate float64) time.Duration {
+	missing := tokens - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	var wait time.Duration
+	if !b.adaptedUntil.IsZero() {
+		adaptedPeriod := b.adaptedUntil.Sub(now)
+		available := b.adaptedRate * adaptedPeriod.Seconds()
+		if available >= missing {
+			return seconds(missing / b.adaptedRate)
+		}
+		missing -= available
+		wait = adaptedPeriod
+	}
+	if rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return wait + seconds(missing/rate)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
@@ -0,0 +1,165 @@
+package aurestratelimit
+
+import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func tstMock() aurestclientapi.Client {
+	mockClient := aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://a/1 <nil>": {
+				Status: 200,
+			},
+			"GET http://b/1 <nil>": {
+				Status: 200,
+			},
+			"GET http://a/limited <nil>": {
+				Status: 200,
+				Header: http.Header{
+					"X-Ratelimit-Remaining": []string{"2"},
+					"X-Ratelimit-Reset":     []string{"20"},
+				},
+			},
+		},
+		map[string]error{},
+	)
+	return aurestcapture.New(mockClient)
+}
+
+type tstClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *tstClock) Now() time.Time {
+	return c.now
+}
+
+func (c *tstClock) Sleep(ctx context.Context, duration time.Duration) error {
+	c.sleeps = append(c.sleeps, duration)
+	c.now = c.now.Add(duration)
+	return ctx.Err()
+}
+
+func tstCut(opts RateLimitOptions) (*RateLimitImpl, *tstClock) {
+	cut := NewWithOptions(tstMock(), opts).(*RateLimitImpl)
+	clock := &tstClock{now: time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC), sleeps: make([]time.Duration, 0)}
+	cut.Now = clock.Now
+	cut.Sleep = clock.Sleep
+	return cut, clock
+}
+
+func tstPerform(ctx context.Context, cut aurestclientapi.Client, requestUrl string) error {
+	return cut.Perform(ctx, "GET", requestUrl, nil, &aurestclientapi.ParsedResponse{})
+}
+
+func TestWaitsForToken(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, clock := tstCut(RateLimitOptions{
+		Rate:  2,
+		Burst: 2,
+	})
+
+	for i := 0; i < 4; i++ {
+		require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	}
+	require.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}, clock.sleeps)
+
+	// refills up to the burst
+	clock.now = clock.now.Add(time.Hour)
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Equal(t, 2, len(clock.sleeps))
+}
+
+func TestFailFastPerHost(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, _ := tstCut(RateLimitOptions{
+		Rate:          1,
+		LimitKeyOrNil: PerHost,
+		FailFast:      true,
+	})
+	rejected := 0
+	Instrument(cut, nil, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+		rejected++
+	})
+
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Nil(t, tstPerform(context.Background(), cut, "http://b/1"))
+
+	err := tstPerform(context.Background(), cut, "http://a/1")
+	require.True(t, IsRateLimited(err))
+	require.True(t, aurestnontripping.Is(err))
+	require.Equal(t, "rate limit exceeded for 'a', next token in 1s", err.Error())
+	require.Equal(t, 1, rejected)
+}
+
+func TestRespectsDeadline(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, clock := tstCut(RateLimitOptions{
+		Rate: 0.1,
+	})
+	ctx, cancel := context.WithDeadline(context.Background(), clock.now.Add(5*time.Second))
+	defer cancel()
+
+	require.Nil(t, tstPerform(ctx, cut, "http://a/1"))
+	err := tstPerform(ctx, cut, "http://a/1")
+	require.True(t, IsRateLimited(err))
+	require.Equal(t, 10*time.Second, err.(*RateLimitedError).Wait)
+	require.Equal(t, 0, len(clock.sleeps))
+
+	// the rejected request did not take a token
+	clock.now = clock.now.Add(10 * time.Second)
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Equal(t, 0, len(clock.sleeps))
+}
+
+func TestAdaptsFromHeaders(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut, clock := tstCut(RateLimitOptions{
+		Rate:             10,
+		Burst:            10,
+		AdaptFromHeaders: true,
+	})
+
+	// downstream reports 2 remaining requests in the next 20 seconds, so these are spread out
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/limited"))
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Equal(t, 0, len(clock.sleeps))
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Equal(t, []time.Duration{10 * time.Second, 10 * time.Second}, clock.sleeps)
+
+	// after the reset the configured rate applies again
+	require.Nil(t, tstPerform(context.Background(), cut, "http://a/1"))
+	require.Equal(t, 100*time.Millisecond, clock.sleeps[2])
+}
+
+func TestParseReset(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	resetAt, ok := parseReset("30", now)
+	require.True(t, ok)
+	require.Equal(t, now.Add(30*time.Second), resetAt)
+
+	resetAt, ok = parseReset("1641038460", now)
+	require.True(t, ok)
+	require.Equal(t, now.Add(time.Minute), resetAt.UTC())
+
+	_, ok = parseReset("soon", now)
+	require.False(t, ok)
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
 	"net/url"
 	"os"
 	"strings"
@@ -18,12 +19,18 @@ type RecorderImpl struct {
 	Wrapped               aurestclientapi.Client
 	RecorderPath          string
 	ConstructFilenameFunc ConstructFilenameFunction
+	Redactor              *aurestredaction.Redactor
 }
 
 const RecorderPathEnvVariable = "GO_AUTUMN_RESTCLIENT_RECORDER_PATH"
 
 type RecorderOptions struct {
 	ConstructFilenameFunc ConstructFilenameFunction
+
+	// RedactorOrNil masks secrets in the recorded url, headers and bodies. Defaults to aurestredaction.Default().
+	//
+	// The filename is still constructed from the original request, so playback finds the recording.
+	RedactorOrNil *aurestredaction.Redactor
 }
 
 // New builds a new http recorder.
@@ -41,6 +48,7 @@ func New(wrapped aurestclientapi.Client, additionalOptions ...RecorderOptions) a
 		Wrapped:               wrapped,
 		RecorderPath:          recorderPath,
 		ConstructFilenameFunc: filenameFunc,
+		Redactor:              redactorFromOptions(additionalOptions),
 	}
 }
 
@@ -60,6 +68,16 @@ func initRecorderPathAndFilenameFunc(additionalOptions []RecorderOptions) (strin
 	return recorderPath, filenameFunc
 }
 
+func redactorFromOptions(additionalOptions []RecorderOptions) *aurestredaction.Redactor {
+	var redactor *aurestredaction.Redactor
+	for _, o := range additionalOptions {
+		if o.RedactorOrNil != nil {
+			redactor = o.RedactorOrNil
+		}
+	}
+	return redactor
+}
+
 type RecorderData struct {
 	Method         string                         `json:"method"`
 	RequestUrl     string                         `json:"requestUrl"`
@@ -71,21 +89,25 @@ type RecorderData struct {
 func (c *RecorderImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
 	responseErr := c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
 
-	recordResponseData(method, requestUrl, requestBody, response, responseErr, c.RecorderPath, c.ConstructFilenameFunc)
+	recordResponseData(method, requestUrl, requestBody, response, responseErr, c.RecorderPath, c.ConstructFilenameFunc, c.Redactor)
 	return responseErr
 }
 
 func recordResponseData(method string, requestUrl string, requestBody interface{},
 	response *aurestclientapi.ParsedResponse, responseErr error,
-	recorderPath string, constructFilenameFunc ConstructFilenameFunction) {
+	recorderPath string, constructFilenameFunc ConstructFilenameFunction, redactor *aurestredaction.Redactor) {
 	if recorderPath != "" {
 		filename, err := constructFilenameFunc(method, requestUrl, requestBody)
 		if err == nil {
+			redactor = aurestredaction.Use(redactor)
+			recordedResponse := *response
+			recordedResponse.Header = redactor.Header(response.Header)
+			recordedResponse.Body = redactor.Body(response.Body)
 			recording := RecorderData{
 				Method:         method,
-				RequestUrl:     requestUrl,
-				RequestBody:    requestBody,
-				ParsedResponse: *response,
+				RequestUrl:     redactor.Url(requestUrl),
+				RequestBody:    redactor.Body(requestBody),
+				ParsedResponse: recordedResponse,
 				Error:          responseErr,
 			}
 
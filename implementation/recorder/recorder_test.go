@@ -1,7 +1,15 @@
 package aurestrecorder
 
 import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
 	"github.com/stretchr/testify/require"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -62,3 +70,47 @@ func TestConstructEqualFilenameV3ForDifferentQueryParameterOrder(t *testing.T) {
 
 	require.Equal(t, actual1, actual2)
 }
+
+func TestRecordingIsRedacted(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorderPath := t.TempDir()
+	t.Setenv(RecorderPathEnvVariable, recorderPath)
+
+	requestUrl := "https://some.short.server.name/api/rest/v1/login?apikey=s3cr3t"
+	mockClient := aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"POST " + requestUrl + " map[password:pw user:kitten]": {
+				Status: 200,
+				Header: http.Header{"Set-Cookie": []string{"session=abc"}},
+				Body:   map[string]string{"token": "t0k3n"},
+			},
+		},
+		map[string]error{},
+	)
+	cut := New(mockClient, RecorderOptions{
+		RedactorOrNil: aurestredaction.New(aurestredaction.RedactionOptions{
+			QueryParameters: []string{"apikey"},
+			Headers:         []string{"Set-Cookie"},
+			BodyFields:      []string{"password", "token"},
+		}),
+	})
+
+	var responseBody map[string]string
+	response := &aurestclientapi.ParsedResponse{Body: &responseBody}
+	err := cut.Perform(context.Background(), "POST", requestUrl, map[string]string{"user": "kitten", "password": "pw"}, response)
+	require.Nil(t, err)
+	// the caller still gets the real response
+	require.Equal(t, "t0k3n", responseBody["token"])
+
+	filename, err := ConstructFilenameV3WithBody("POST", requestUrl, nil)
+	require.Nil(t, err)
+	recording, err := os.ReadFile(filepath.Join(recorderPath, filename))
+	require.Nil(t, err)
+	require.Contains(t, string(recording), `"requestUrl": "https://some.short.server.name/api/rest/v1/login?apikey=***"`)
+	require.Contains(t, string(recording), `"password": "***"`)
+	require.Contains(t, string(recording), `"token": "***"`)
+	require.NotContains(t, string(recording), "s3cr3t")
+	require.NotContains(t, string(recording), "session=abc")
+	require.NotContains(t, string(recording), "t0k3n")
+}
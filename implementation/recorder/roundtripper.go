@@ -3,6 +3,7 @@ package aurestrecorder
 import (
 	"bytes"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
 	"io"
 	"net/http"
 	"strings"
@@ -13,6 +14,7 @@ type RecorderRoundTripper struct {
 	wrapped               http.RoundTripper
 	recorderPath          string
 	constructFilenameFunc ConstructFilenameFunction
+	redactor              *aurestredaction.Redactor
 }
 
 func NewRecorderRoundTripper(wrapped http.RoundTripper, additionalOptions ...RecorderOptions) *RecorderRoundTripper {
@@ -21,6 +23,7 @@ func NewRecorderRoundTripper(wrapped http.RoundTripper, additionalOptions ...Rec
 		wrapped:               wrapped,
 		recorderPath:          recorderPath,
 		constructFilenameFunc: filenameFunc,
+		redactor:              redactorFromOptions(additionalOptions),
 	}
 }
 
@@ -41,7 +44,7 @@ func (c *RecorderRoundTripper) RoundTrip(req *http.Request) (*http.Response, err
 			requestBody, _ = req.GetBody()
 			requestBodyString = readBody(requestBody)
 		}
-		recordResponseData(req.Method, req.URL.String(), requestBodyString, &parsedResponse, err, c.recorderPath, c.constructFilenameFunc)
+		recordResponseData(req.Method, req.URL.String(), requestBodyString, &parsedResponse, err, c.recorderPath, c.constructFilenameFunc, c.redactor)
 	}
 	return response, err
 }
@@ -0,0 +1,325 @@
+package aurestredaction
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultMask replaces redacted values unless RedactionOptions.Mask is set.
+const DefaultMask = "***"
+
+// DefaultSensitiveHeaders is a starting point for RedactionOptions.Headers.
+var DefaultSensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+type RedactionOptions struct {
+	// QueryParameters lists the names of query parameters whose values are masked. Case-insensitive.
+	QueryParameters []string
+
+	// Headers lists the names of headers whose values are masked. Case-insensitive.
+	Headers []string
+
+	// BodyFields lists paths of json fields whose values are masked, with the segments separated by dots,
+	// e.g. "credentials.password". A "*" segment matches any field name. Arrays are traversed, so
+	// "items.secret" masks the secret of every element of items.
+	BodyFields []string
+
+	// Mask defaults to DefaultMask.
+	Mask string
+}
+
+// Redactor masks secrets before urls, headers and bodies are logged or written anywhere.
+//
+// All methods may be called on a nil *Redactor, which leaves everything unchanged.
+type Redactor struct {
+	queryParameters map[string]struct{}
+	headers         map[string]struct{}
+	bodyFields      [][]string
+	mask            string
+}
+
+// New builds a Redactor. Pass it to the layers that should use it, or make it the default with SetDefault.
+func New(opts RedactionOptions) *Redactor {
+	r := &Redactor{
+		queryParameters: make(map[string]struct{}),
+		headers:         make(map[string]struct{}),
+		mask:            DefaultMask,
+	}
+	for _, name := range opts.QueryParameters {
+		r.queryParameters[strings.ToLower(name)] = struct{}{}
+	}
+	for _, name := range opts.Headers {
+		r.headers[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	for _, path := range opts.BodyFields {
+		r.bodyFields = append(r.bodyFields, strings.Split(path, "."))
+	}
+	if opts.Mask != "" {
+		r.mask = opts.Mask
+	}
+	return r
+}
+
+var (
+	defaultMutex    sync.RWMutex
+	defaultRedactor *Redactor
+)
+
+// SetDefault sets the Redactor used by all layers that were not given one of their own. nil switches
+// redaction off again.
+func SetDefault(r *Redactor) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultRedactor = r
+}
+
+// Default returns the Redactor set with SetDefault, or nil.
+func Default() *Redactor {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultRedactor
+}
+
+// Use returns r, or the default Redactor if r is nil.
+func Use(r *Redactor) *Redactor {
+	if r != nil {
+		return r
+	}
+	return Default()
+}
+
+// Url masks the values of sensitive query parameters, and the password in the user info, if any.
+//
+// Urls that cannot be parsed are returned unchanged.
+func (r *Redactor) Url(requestUrl string) string {
+	if r == nil {
+		return requestUrl
+	}
+	parsed, err := url.Parse(requestUrl)
+	if err != nil {
+		return requestUrl
+	}
+
+	changed := false
+	if parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			// the mask is inserted after encoding, so it is not percent-encoded
+			parsed.User = url.UserPassword(parsed.User.Username(), passwordPlaceholder)
+			changed = true
+		}
+	}
+	if parsed.RawQuery != "" && len(r.queryParameters) > 0 {
+		// keep the order and encoding of the parameters, only replace values
+		pairs := strings.Split(parsed.RawQuery, "&")
+		for i, pair := range pairs {
+			rawName := pair
+			if idx := strings.Index(pair, "="); idx >= 0 {
+				rawName = pair[:idx]
+			}
+			name, err := url.QueryUnescape(rawName)
+			if err != nil {
+				name = rawName
+			}
+			if _, ok := r.queryParameters[strings.ToLower(name)]; ok {
+				pairs[i] = rawName + "=" + r.mask
+				changed = true
+			}
+		}
+		parsed.RawQuery = strings.Join(pairs, "&")
+	}
+
+	if !changed {
+		return requestUrl
+	}
+	return strings.Replace(parsed.String(), ":"+passwordPlaceholder+"@", ":"+r.mask+"@", 1)
+}
+
+const passwordPlaceholder = "redactedpassword"
+
+// Text masks sensitive query parameters of all urls found in s, which must be separated by whitespace,
+// such as in cache keys.
+func (r *Redactor) Text(s string) string {
+	if r == nil {
+		return s
+	}
+	fields := strings.Split(s, " ")
+	for i, field := range fields {
+		if strings.Contains(field, "://") {
+			fields[i] = r.Url(field)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// Header returns a copy of header with the values of sensitive headers masked, or header itself
+// if there is nothing to mask.
+func (r *Redactor) Header(header http.Header) http.Header {
+	if r == nil || len(r.headers) == 0 || header == nil {
+		return header
+	}
+	var redacted http.Header
+	for name, values := range header {
+		if _, ok := r.headers[http.CanonicalHeaderKey(name)]; ok {
+			if redacted == nil {
+				redacted = header.Clone()
+			}
+			masked := make([]string, len(values))
+			for i := range masked {
+				masked[i] = r.mask
+			}
+			redacted[name] = masked
+		}
+	}
+	if redacted == nil {
+		return header
+	}
+	return redacted
+}
+
+// Body returns body with sensitive json fields masked.
+//
+// Structs and maps are returned as generic json values (maps, slices etc.). Strings and byte slices holding
+// json are returned as the same type. If nothing is masked, or body cannot be represented as json
+// (such as a aurestclientapi.CustomRequestBody), body itself is returned.
+func (r *Redactor) Body(body interface{}) interface{} {
+	if r == nil || len(r.bodyFields) == 0 || body == nil {
+		return body
+	}
+
+	var raw []byte
+	switch typed := body.(type) {
+	case aurestclientapi.CustomRequestBody, *aurestclientapi.CustomRequestBody:
+		return body
+	case string:
+		raw = []byte(typed)
+	case []byte:
+		raw = typed
+	default:
+		var err error
+		raw, err = json.Marshal(body)
+		if err != nil {
+			return body
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return body
+	}
+
+	changed := false
+	for _, path := range r.bodyFields {
+		if r.redactPath(generic, path) {
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+
+	switch body.(type) {
+	case string, []byte:
+		redactedJson, err := json.Marshal(generic)
+		if err != nil {
+			return body
+		}
+		if _, ok := body.(string); ok {
+			return string(redactedJson)
+		}
+		return redactedJson
+	default:
+		return generic
+	}
+}
+
+func (r *Redactor) redactPath(value interface{}, path []string) bool {
+	changed := false
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				typed[key] = r.mask
+				changed = true
+			} else if r.redactPath(child, path[1:]) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, element := range typed {
+			if r.redactPath(element, path) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// urlInText matches urls embedded in error messages. Quotes, whitespace and angle brackets end a url.
+var urlInText = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// Error returns err with all urls in its message redacted. The returned error wraps err, so errors.Is and
+// errors.As still work, and it is a non-tripping error if err is one.
+//
+// Every url found in the message is redacted, not just requestUrl, because layers such as the load balancer
+// rewrite the url, and net/http changes the user info in its error messages.
+func (r *Redactor) Error(err error, requestUrl string) error {
+	if r == nil || err == nil {
+		return err
+	}
+	original := err.Error()
+	message := original
+	if redactedUrl := r.Url(requestUrl); redactedUrl != requestUrl {
+		message = strings.ReplaceAll(message, requestUrl, redactedUrl)
+	}
+	message = urlInText.ReplaceAllStringFunc(message, r.Url)
+	if message == original {
+		return err
+	}
+	redacted := &redactedError{
+		wrapped: err,
+		message: message,
+	}
+	if nonTripping, ok := err.(aurestnontripping.NonTrippingError); ok {
+		return &redactedNonTrippingError{redactedError: redacted, nonTripping: nonTripping}
+	}
+	return redacted
+}
+
+type redactedError struct {
+	wrapped error
+	message string
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.wrapped
+}
+
+// redactedNonTrippingError keeps a redacted non-tripping error recognizable by aurestnontripping.Is.
+type redactedNonTrippingError struct {
+	*redactedError
+	nonTripping aurestnontripping.NonTrippingError
+}
+
+func (e *redactedNonTrippingError) Ctx() context.Context {
+	return e.nonTripping.Ctx()
+}
+
+func (e *redactedNonTrippingError) IsNonTrippingError() bool {
+	return true
+}
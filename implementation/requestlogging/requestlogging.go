@@ -2,10 +2,14 @@ package aurestlogging
 
 import (
 	"context"
+	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	auloggingapi "github.com/StephanHCB/go-autumn-logging/api"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
 	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -19,6 +23,9 @@ type RequestLoggingOptions struct {
 	BeforeRequest func(ctx context.Context) auloggingapi.LeveledLoggingImplementation
 	Success       func(ctx context.Context) auloggingapi.LeveledLoggingImplementation
 	Failure       func(ctx context.Context) auloggingapi.LeveledLoggingImplementation
+
+	// RedactorOrNil masks secrets in the logged urls and errors. Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
 }
 
 func Debug(ctx context.Context) auloggingapi.LeveledLoggingImplementation {
@@ -56,6 +63,7 @@ func NewWithOptions(wrapped aurestclientapi.Client, opts RequestLoggingOptions)
 	if opts.Failure != nil {
 		instance.Options.Failure = opts.Failure
 	}
+	instance.Options.RedactorOrNil = opts.RedactorOrNil
 	return instance
 }
 
@@ -79,20 +87,70 @@ func (c *RequestLoggingImpl) Perform(ctx context.Context, method string, request
 	return err
 }
 
+// Names of the structured fields added to the log messages, in addition to the human-readable message.
+//
+// The error is added through WithErr, so its field name depends on the logging implementation.
+const (
+	FieldMethod      = "method"
+	FieldUrl         = "url"
+	FieldHost        = "host"
+	FieldStatus      = "status"
+	FieldDurationMs  = "duration_ms"
+	FieldAttempt     = "attempt"
+	FieldNonTripping = "nontripping"
+)
+
 func logRequest(ctx context.Context, method string, requestUrl string, opts *RequestLoggingOptions) time.Time {
-	opts.BeforeRequest(ctx).Printf("downstream %s %s...", method, requestUrl)
+	requestUrl = aurestredaction.Use(opts.RedactorOrNil).Url(requestUrl)
+	withRequestFields(opts.BeforeRequest(ctx), ctx, method, requestUrl).
+		Printf("downstream %s %s%s...", method, requestUrl, attemptInfo(ctx))
 	return time.Now()
 }
 
 func logResponse(ctx context.Context, method string, requestUrl string, responseStatusCode int, err error, startTime time.Time, opts *RequestLoggingOptions) {
 	reqDuration := time.Now().Sub(startTime).Milliseconds()
+	attempt := attemptInfo(ctx)
+	nonTripping := aurestnontripping.Is(err)
+	redactor := aurestredaction.Use(opts.RedactorOrNil)
+	err = redactor.Error(err, requestUrl)
+	requestUrl = redactor.Url(requestUrl)
 	if err != nil {
-		if aurestnontripping.Is(err) {
-			opts.Failure(ctx).WithErr(err).Printf("downstream %s %s -> %d FAILED (%d ms) (nontripping)", method, requestUrl, responseStatusCode, reqDuration)
+		logger := withResponseFields(opts.Failure(ctx), ctx, method, requestUrl, responseStatusCode, reqDuration).
+			With(FieldNonTripping, strconv.FormatBool(nonTripping)).
+			WithErr(err)
+		if nonTripping {
+			logger.Printf("downstream %s %s%s -> %d FAILED (%d ms) (nontripping)", method, requestUrl, attempt, responseStatusCode, reqDuration)
 		} else {
-			opts.Failure(ctx).WithErr(err).Printf("downstream %s %s -> %d FAILED (%d ms)", method, requestUrl, responseStatusCode, reqDuration)
+			logger.Printf("downstream %s %s%s -> %d FAILED (%d ms)", method, requestUrl, attempt, responseStatusCode, reqDuration)
 		}
 	} else {
-		opts.Success(ctx).Printf("downstream %s %s -> %d OK (%d ms)", method, requestUrl, responseStatusCode, reqDuration)
+		withResponseFields(opts.Success(ctx), ctx, method, requestUrl, responseStatusCode, reqDuration).
+			Printf("downstream %s %s%s -> %d OK (%d ms)", method, requestUrl, attempt, responseStatusCode, reqDuration)
+	}
+}
+
+func withRequestFields(logger auloggingapi.LeveledLoggingImplementation, ctx context.Context, method string, requestUrl string) auloggingapi.LeveledLoggingImplementation {
+	logger = logger.With(FieldMethod, method).With(FieldUrl, requestUrl)
+	if parsed, err := url.Parse(requestUrl); err == nil && parsed.Host != "" {
+		logger = logger.With(FieldHost, parsed.Host)
+	}
+	if attempt := aurestclientapi.AttemptFromContext(ctx); attempt > 0 {
+		logger = logger.With(FieldAttempt, strconv.Itoa(int(attempt)))
+	}
+	return logger
+}
+
+func withResponseFields(logger auloggingapi.LeveledLoggingImplementation, ctx context.Context, method string, requestUrl string, responseStatusCode int, reqDuration int64) auloggingapi.LeveledLoggingImplementation {
+	return withRequestFields(logger, ctx, method, requestUrl).
+		With(FieldStatus, strconv.Itoa(responseStatusCode)).
+		With(FieldDurationMs, strconv.FormatInt(reqDuration, 10))
+}
+
+// attemptInfo describes retries for the log message. Empty for the first attempt, so the
+// message is unchanged if there is no retry.
+func attemptInfo(ctx context.Context) string {
+	if attempt := aurestclientapi.AttemptFromContext(ctx); attempt > 1 {
+		return fmt.Sprintf(" (attempt %d)", attempt)
 	}
+	return ""
 }
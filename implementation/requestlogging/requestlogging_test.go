@@ -0,0 +1,204 @@
+package aurestlogging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	auloggingapi "github.com/StephanHCB/go-autumn-logging/api"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type recordedEntry struct {
+	level   string
+	fields  map[string]string
+	err     error
+	message string
+}
+
+type recordingLogger struct {
+	entries []*recordedEntry
+}
+
+func (r *recordingLogger) leveled(level string) func(ctx context.Context) auloggingapi.LeveledLoggingImplementation {
+	return func(ctx context.Context) auloggingapi.LeveledLoggingImplementation {
+		entry := &recordedEntry{level: level, fields: make(map[string]string)}
+		r.entries = append(r.entries, entry)
+		return &recordingLeveled{entry: entry}
+	}
+}
+
+func (r *recordingLogger) options() RequestLoggingOptions {
+	return RequestLoggingOptions{
+		BeforeRequest: r.leveled("debug"),
+		Success:       r.leveled("info"),
+		Failure:       r.leveled("warn"),
+	}
+}
+
+type recordingLeveled struct {
+	entry *recordedEntry
+}
+
+func (l *recordingLeveled) WithErr(err error) auloggingapi.LeveledLoggingImplementation {
+	l.entry.err = err
+	return l
+}
+
+func (l *recordingLeveled) With(key string, value string) auloggingapi.LeveledLoggingImplementation {
+	l.entry.fields[key] = value
+	return l
+}
+
+func (l *recordingLeveled) Print(v ...interface{}) {
+	l.entry.message = fmt.Sprint(v...)
+}
+
+func (l *recordingLeveled) Printf(format string, v ...interface{}) {
+	l.entry.message = fmt.Sprintf(format, v...)
+}
+
+func tstMock() aurestclientapi.Client {
+	return aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://a.example.com:8080/items?x=1 <nil>": {
+				Status: 200,
+			},
+		},
+		map[string]error{
+			"GET http://a.example.com/broken <nil>":      errors.New("connection refused"),
+			"GET http://a.example.com/nontripping <nil>": aurestnontripping.New(context.Background(), errors.New("invalid json")),
+		},
+	)
+}
+
+func TestStructuredFieldsSuccess(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	logger := &recordingLogger{}
+	cut := NewWithOptions(tstMock(), logger.options())
+
+	err := cut.Perform(context.Background(), "GET", "http://a.example.com:8080/items?x=1", nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+
+	require.Equal(t, 2, len(logger.entries))
+	require.Equal(t, "downstream GET http://a.example.com:8080/items?x=1...", logger.entries[0].message)
+	require.Equal(t, map[string]string{
+		"method": "GET",
+		"url":    "http://a.example.com:8080/items?x=1",
+		"host":   "a.example.com:8080",
+	}, logger.entries[0].fields)
+
+	response := logger.entries[1]
+	require.Equal(t, "info", response.level)
+	require.Regexp(t, `^downstream GET http://a.example.com:8080/items\?x=1 -> 200 OK \(\d+ ms\)$`, response.message)
+	require.Equal(t, "GET", response.fields["method"])
+	require.Equal(t, "a.example.com:8080", response.fields["host"])
+	require.Equal(t, "200", response.fields["status"])
+	require.Regexp(t, `^\d+$`, response.fields["duration_ms"])
+	require.NotContains(t, response.fields, "nontripping")
+	require.NotContains(t, response.fields, "attempt")
+	require.Nil(t, response.err)
+}
+
+func TestStructuredFieldsFailure(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	logger := &recordingLogger{}
+	cut := NewWithOptions(tstMock(), logger.options())
+
+	err := cut.Perform(context.Background(), "GET", "http://a.example.com/broken", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	response := logger.entries[1]
+	require.Equal(t, "warn", response.level)
+	require.Regexp(t, `^downstream GET http://a.example.com/broken -> 0 FAILED \(\d+ ms\)$`, response.message)
+	require.Equal(t, "false", response.fields["nontripping"])
+	require.Equal(t, "0", response.fields["status"])
+	require.Equal(t, err, response.err)
+
+	err = cut.Perform(context.Background(), "GET", "http://a.example.com/nontripping", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	response = logger.entries[3]
+	require.Regexp(t, `\(nontripping\)$`, response.message)
+	require.Equal(t, "true", response.fields["nontripping"])
+}
+
+func TestStructuredFieldsRoundTripper(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	cut := NewLoggingRoundTripperWithOpts(http.DefaultTransport, logger.options())
+
+	request, err := http.NewRequest(http.MethodDelete, server.URL+"/items/1", nil)
+	require.Nil(t, err)
+	response, err := cut.RoundTrip(request)
+	require.Nil(t, err)
+	_ = response.Body.Close()
+
+	require.Equal(t, 2, len(logger.entries))
+	fields := logger.entries[1].fields
+	require.Equal(t, "DELETE", fields["method"])
+	require.Equal(t, server.URL+"/items/1", fields["url"])
+	require.Equal(t, request.URL.Host, fields["host"])
+	require.Equal(t, "204", fields["status"])
+}
+
+func TestRedaction(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	logger := &recordingLogger{}
+	opts := logger.options()
+	opts.RedactorOrNil = aurestredaction.New(aurestredaction.RedactionOptions{
+		QueryParameters: []string{"apikey"},
+	})
+	failing := &failingClient{}
+	cut := NewWithOptions(failing, opts)
+
+	err := cut.Perform(context.Background(), "GET", "http://a.example.com/items?apikey=s3cr3t", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	// the caller gets the original error
+	require.Contains(t, err.Error(), "s3cr3t")
+
+	for _, entry := range logger.entries {
+		require.NotContains(t, entry.message, "s3cr3t")
+		require.NotContains(t, entry.fields["url"], "s3cr3t")
+	}
+	require.Equal(t, "http://a.example.com/items?apikey=***", logger.entries[1].fields["url"])
+	require.Equal(t, `Get "http://a.example.com/items?apikey=***": connection refused`, logger.entries[1].err.Error())
+	require.True(t, errors.Is(logger.entries[1].err, err))
+	require.Equal(t, "false", logger.entries[1].fields["nontripping"])
+
+	// redaction keeps non-tripping errors non-tripping
+	failing.nonTripping = true
+	err = cut.Perform(context.Background(), "GET", "http://a.example.com/items?apikey=s3cr3t", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, aurestnontripping.Is(err))
+	require.Regexp(t, `\(nontripping\)$`, logger.entries[3].message)
+	require.Equal(t, "true", logger.entries[3].fields["nontripping"])
+	require.True(t, aurestnontripping.Is(logger.entries[3].err))
+	require.NotContains(t, logger.entries[3].err.Error(), "s3cr3t")
+}
+
+type failingClient struct {
+	nonTripping bool
+}
+
+func (c *failingClient) Perform(ctx context.Context, _ string, requestUrl string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	err := error(&url.Error{Op: "Get", URL: requestUrl, Err: errors.New("connection refused")})
+	if c.nonTripping {
+		return aurestnontripping.New(ctx, err)
+	}
+	return err
+}
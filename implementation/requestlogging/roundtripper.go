@@ -27,6 +27,7 @@ func NewLoggingRoundTripperWithOpts(wrapped http.RoundTripper, opts RequestLoggi
 	if opts.Failure != nil {
 		instance.Options.Failure = opts.Failure
 	}
+	instance.Options.RedactorOrNil = opts.RedactorOrNil
 	return instance
 }
 
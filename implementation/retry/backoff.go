@@ -0,0 +1,89 @@
+package aurestretry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// BackoffFunction calculates the delay before the next retry.
+//
+// retry is 1 before the first retry, 2 before the second, and so on. previousDelay is the delay that was
+// returned for the previous retry (0 before the first retry). A longer wait requested by a Retry-After header
+// is not reflected in previousDelay.
+type BackoffFunction func(retry uint8, previousDelay time.Duration) time.Duration
+
+// SleepFunction waits for the given duration, but must return early with an error if the context is done.
+type SleepFunction func(ctx context.Context, duration time.Duration) error
+
+// ConstantBackoff waits the same delay before each retry.
+func ConstantBackoff(delay time.Duration) BackoffFunction {
+	return func(_ uint8, _ time.Duration) time.Duration {
+		return delay
+	}
+}
+
+// LinearBackoff waits initial before the first retry, and increment more before each further retry, up to max.
+//
+// max <= 0 means no maximum.
+func LinearBackoff(initial time.Duration, increment time.Duration, max time.Duration) BackoffFunction {
+	return func(retry uint8, _ time.Duration) time.Duration {
+		return capDelay(initial+time.Duration(retry-1)*increment, max)
+	}
+}
+
+// ExponentialBackoff waits initial before the first retry, and multiplies the delay by factor before each
+// further retry, up to max.
+//
+// max <= 0 means no maximum.
+func ExponentialBackoff(initial time.Duration, factor float64, max time.Duration) BackoffFunction {
+	return func(retry uint8, previousDelay time.Duration) time.Duration {
+		if retry <= 1 || previousDelay <= 0 {
+			return capDelay(initial, max)
+		}
+		return capDelay(time.Duration(float64(previousDelay)*factor), max)
+	}
+}
+
+// DecorrelatedJitterBackoff waits a random delay between base and three times the previous delay, up to max.
+//
+// This spreads out the retries of many clients that failed at the same time, see
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+//
+// max <= 0 means no maximum.
+func DecorrelatedJitterBackoff(base time.Duration, max time.Duration) BackoffFunction {
+	return func(_ uint8, previousDelay time.Duration) time.Duration {
+		if previousDelay < base {
+			previousDelay = base
+		}
+		upper := 3 * previousDelay
+		if upper <= base {
+			return capDelay(base, max)
+		}
+		return capDelay(base+time.Duration(rand.Int63n(int64(upper-base))), max)
+	}
+}
+
+func capDelay(delay time.Duration, max time.Duration) time.Duration {
+	if max > 0 && delay > max {
+		return max
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+func contextSleep(ctx context.Context, duration time.Duration) error {
+	if duration <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
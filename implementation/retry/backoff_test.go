@@ -0,0 +1,100 @@
+package aurestretry
+
+import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(50 * time.Millisecond)
+	require.Equal(t, 50*time.Millisecond, b(1, 0))
+	require.Equal(t, 50*time.Millisecond, b(3, 50*time.Millisecond))
+}
+
+func TestLinearBackoff(t *testing.T) {
+	b := LinearBackoff(100*time.Millisecond, 50*time.Millisecond, 180*time.Millisecond)
+	require.Equal(t, 100*time.Millisecond, b(1, 0))
+	require.Equal(t, 150*time.Millisecond, b(2, 100*time.Millisecond))
+	require.Equal(t, 180*time.Millisecond, b(3, 150*time.Millisecond))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(100*time.Millisecond, 2, time.Second)
+	delay := time.Duration(0)
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expected {
+		delay = b(uint8(i+1), delay)
+		require.Equal(t, e*time.Millisecond, delay)
+	}
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	b := DecorrelatedJitterBackoff(100*time.Millisecond, time.Second)
+	delay := time.Duration(0)
+	for i := 1; i < 50; i++ {
+		previous := delay
+		delay = b(uint8(i), delay)
+		require.True(t, delay >= 100*time.Millisecond)
+		require.True(t, delay <= time.Second)
+		if previous > 0 {
+			require.True(t, delay <= 3*previous)
+		}
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := NewWithOptions(mock,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			return true
+		},
+		RetryOptions{
+			RepeatCount:  3,
+			BackoffOrNil: ExponentialBackoff(10*time.Millisecond, 2, 0),
+		},
+	)
+	sleeps := make([]time.Duration, 0)
+	cut.(*RetryImpl).Sleep = func(ctx context.Context, duration time.Duration) error {
+		sleeps = append(sleeps, duration)
+		return nil
+	}
+
+	err := cut.Perform(context.Background(), "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	r := "GET http://err <nil>"
+	require.Equal(t, []string{r, r, r, r}, aurestcapture.GetRecording(mock))
+	require.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}, sleeps)
+}
+
+func TestRetryBackoffAbortsOnCancel(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := NewWithOptions(mock,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			return true
+		},
+		RetryOptions{
+			RepeatCount:     3,
+			BackoffOrNil:    ConstantBackoff(time.Hour),
+			SilenceGivingUp: true,
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := cut.Perform(ctx, "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	require.Equal(t, "some transport error", err.Error())
+	require.True(t, time.Since(start) < time.Second)
+	require.Equal(t, []string{"GET http://err <nil>"}, aurestcapture.GetRecording(mock))
+}
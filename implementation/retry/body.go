@@ -0,0 +1,12 @@
+package aurestretry
+
+import (
+	aurestbodyreplay "github.com/StephanHCB/go-autumn-restclient/implementation/internal/bodyreplay"
+)
+
+// DefaultMaxBufferedBodySize is the default for RetryOptions.MaxBufferedBodySize.
+const DefaultMaxBufferedBodySize = aurestbodyreplay.DefaultMaxBufferedSize
+
+// ErrBodyNotReplayable is wrapped into the (non-tripping) error returned when a retry would be needed,
+// but the custom request body cannot be sent again. It is the same error as aurestloadbalancer.ErrBodyNotReplayable.
+var ErrBodyNotReplayable = aurestbodyreplay.ErrNotReplayable
@@ -0,0 +1,103 @@
+package aurestretry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+)
+
+// bodyRecordingClient reads the complete request body on each attempt and always fails
+type bodyRecordingClient struct {
+	bodies []string
+}
+
+func (c *bodyRecordingClient) Perform(_ context.Context, _ string, _ string, requestBody interface{}, _ *aurestclientapi.ParsedResponse) error {
+	custom := requestBody.(aurestclientapi.CustomRequestBody)
+	contents, _ := io.ReadAll(custom.BodyReader)
+	c.bodies = append(c.bodies, string(contents))
+	return errors.New("some transport error")
+}
+
+// onlyReader hides all methods except Read, so the body can neither be seeked nor recognized as a buffer
+type onlyReader struct {
+	io.Reader
+}
+
+func tstBodyCut(wrapped aurestclientapi.Client, maxBuffered int) aurestclientapi.Client {
+	return NewWithOptions(wrapped,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			return err != nil && !aurestnontripping.Is(err)
+		},
+		RetryOptions{
+			RepeatCount:         2,
+			SilenceGivingUp:     true,
+			MaxBufferedBodySize: maxBuffered,
+		},
+	)
+}
+
+func TestReplaySeekableBody(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &bodyRecordingClient{}
+	cut := tstBodyCut(recorder, 0)
+
+	_ = cut.Perform(context.Background(), "POST", "http://err", aurestclientapi.CustomRequestBody{
+		BodyReader: strings.NewReader("payload"),
+		BodyLength: 7,
+	}, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, []string{"payload", "payload", "payload"}, recorder.bodies)
+}
+
+func TestReplayBufferedBody(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &bodyRecordingClient{}
+	cut := tstBodyCut(recorder, 0)
+
+	_ = cut.Perform(context.Background(), "POST", "http://err", aurestclientapi.CustomRequestBody{
+		BodyReader: bytes.NewBufferString("payload"),
+		BodyLength: 7,
+	}, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, []string{"payload", "payload", "payload"}, recorder.bodies)
+}
+
+func TestReplayGetBody(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &bodyRecordingClient{}
+	cut := tstBodyCut(recorder, 0)
+
+	_ = cut.Perform(context.Background(), "POST", "http://err", aurestclientapi.CustomRequestBody{
+		BodyReader: onlyReader{strings.NewReader("payload")},
+		BodyLength: 7,
+		GetBody: func() (io.Reader, error) {
+			return strings.NewReader("payload"), nil
+		},
+	}, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, []string{"payload", "payload", "payload"}, recorder.bodies)
+}
+
+func TestBodyTooLargeToReplay(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &bodyRecordingClient{}
+	cut := tstBodyCut(recorder, 4)
+
+	err := cut.Perform(context.Background(), "POST", "http://err", aurestclientapi.CustomRequestBody{
+		BodyReader: onlyReader{strings.NewReader("payload")},
+		BodyLength: -1,
+	}, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	require.True(t, aurestnontripping.Is(err))
+	require.True(t, errors.Is(err, ErrBodyNotReplayable))
+	// the first attempt still got the complete body
+	require.Equal(t, []string{"payload"}, recorder.bodies)
+}
@@ -0,0 +1,101 @@
+package aurestretry
+
+import (
+	"sync"
+	"time"
+)
+
+const retryBudgetBuckets = 10
+
+// RetryBudget limits the total number of retries across all requests, to prevent retry storms
+// when a downstream is down.
+//
+// Retries are allowed up to Ratio times the number of successful requests during the last Window, plus
+// MinRetriesPerSecond, so that retries are still possible when there is little traffic.
+//
+// A single RetryBudget can be shared by several RetryImpl instances (see RetryOptions.RetryBudgetOrNil), and is
+// safe for concurrent use.
+type RetryBudget struct {
+	Ratio               float64
+	MinRetriesPerSecond float64
+	Window              time.Duration
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets [retryBudgetBuckets]retryBudgetBucket
+}
+
+type retryBudgetBucket struct {
+	index     int64
+	successes int
+	retries   int
+}
+
+// NewRetryBudget creates a retry budget.
+//
+// ratio is the fraction of successful requests that may be retried, e.g. 0.2 allows 20% extra traffic due to
+// retries. window is the duration over which requests are counted, 0 means 10 seconds.
+func NewRetryBudget(ratio float64, minRetriesPerSecond float64, window time.Duration) *RetryBudget {
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	return &RetryBudget{
+		Ratio:               ratio,
+		MinRetriesPerSecond: minRetriesPerSecond,
+		Window:              window,
+		Now:                 time.Now,
+	}
+}
+
+// RecordSuccess deposits a successful request into the budget.
+func (b *RetryBudget) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.currentBucket().successes++
+}
+
+// TryWithdraw returns true and counts the retry if the budget allows another retry.
+func (b *RetryBudget) TryWithdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current := b.currentBucket()
+
+	successes, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.index > current.index-retryBudgetBuckets {
+			successes += bucket.successes
+			retries += bucket.retries
+		}
+	}
+	available := b.MinRetriesPerSecond*b.Window.Seconds() + b.Ratio*float64(successes) - float64(retries)
+	if available < 1 {
+		return false
+	}
+	current.retries++
+	return true
+}
+
+// currentBucket returns the bucket for the current time, resetting it if it was last used in an earlier window.
+//
+// Must be called with the mutex held.
+func (b *RetryBudget) currentBucket() *retryBudgetBucket {
+	bucketDuration := b.Window / retryBudgetBuckets
+	if bucketDuration <= 0 {
+		bucketDuration = 1
+	}
+	index := b.now().UnixNano() / int64(bucketDuration)
+	bucket := &b.buckets[index%retryBudgetBuckets]
+	if bucket.index != index {
+		*bucket = retryBudgetBucket{index: index}
+	}
+	return bucket
+}
+
+func (b *RetryBudget) now() time.Time {
+	if b.Now == nil {
+		return time.Now()
+	}
+	return b.Now()
+}
@@ -0,0 +1,73 @@
+package aurestretry
+
+import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetRatio(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	budget := NewRetryBudget(0.2, 0, 10*time.Second)
+	budget.Now = func() time.Time {
+		return now
+	}
+
+	require.False(t, budget.TryWithdraw())
+
+	for i := 0; i < 10; i++ {
+		budget.RecordSuccess()
+	}
+	require.True(t, budget.TryWithdraw())
+	require.True(t, budget.TryWithdraw())
+	require.False(t, budget.TryWithdraw())
+
+	// after the window has passed, the successes no longer count
+	now = now.Add(11 * time.Second)
+	for i := 0; i < 5; i++ {
+		budget.RecordSuccess()
+	}
+	require.True(t, budget.TryWithdraw())
+	require.False(t, budget.TryWithdraw())
+}
+
+func TestRetryBudgetMinimum(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	budget := NewRetryBudget(0, 0.5, 4*time.Second)
+	budget.Now = func() time.Time {
+		return now
+	}
+
+	require.True(t, budget.TryWithdraw())
+	require.True(t, budget.TryWithdraw())
+	require.False(t, budget.TryWithdraw())
+}
+
+func TestRetryBudgetSharedBetweenClients(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	budget := NewRetryBudget(0, 0.1, 10*time.Second)
+	denied := 0
+
+	mock := tstMock()
+	cut1 := NewWithOptions(mock, tstAlwaysRetry, RetryOptions{RepeatCount: 3, RetryBudgetOrNil: budget, SilenceGivingUp: true})
+	cut2 := NewWithOptions(mock, tstAlwaysRetry, RetryOptions{RepeatCount: 3, RetryBudgetOrNil: budget, SilenceGivingUp: true})
+	for _, c := range []aurestclientapi.Client{cut1, cut2} {
+		InstrumentRetryBudget(c, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+			denied++
+		})
+	}
+
+	err := cut1.Perform(context.Background(), "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	err = cut2.Perform(context.Background(), "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+
+	// only one retry allowed in the budget, so 2 attempts for the first request, 1 for the second
+	require.Equal(t, 3, len(aurestcapture.GetRecording(mock)))
+	require.Equal(t, 2, denied)
+}
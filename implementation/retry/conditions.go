@@ -0,0 +1,137 @@
+package aurestretry
+
+import (
+	"context"
+	"errors"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"net"
+	"net/http"
+)
+
+// This file contains prebuilt retry conditions that you can combine using And, Or, and Not.
+//
+// For a safe default, use DefaultCondition().
+
+// DefaultCondition retries idempotent requests on network errors, timeouts, and the status codes
+// 408, 429, 502, 503, 504, but never after the context is done or on non-tripping errors.
+func DefaultCondition() aurestclientapi.RetryConditionCallback {
+	return And(
+		NotCancelled,
+		NeverOnNonTripping,
+		IdempotentMethodsOnly,
+		Or(
+			OnNetworkError,
+			OnTimeout,
+			OnStatus(http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+				http.StatusServiceUnavailable, http.StatusGatewayTimeout),
+		),
+	)
+}
+
+// OnNetworkError is true if the attempt failed with an error that is not a non-tripping error
+// and was not caused by the context being done.
+//
+// In this library, non-tripping errors indicate problems with the request or response body, so all other
+// errors from the http client are network errors.
+func OnNetworkError(_ context.Context, _ *aurestclientapi.ParsedResponse, err error) bool {
+	return err != nil &&
+		!aurestnontripping.Is(err) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// OnTimeout is true if the attempt failed with a timeout error, for example because of the http client timeout.
+//
+// Note that if the timeout came from the context passed to Perform, NotCancelled will prevent the retry.
+func OnTimeout(_ context.Context, _ *aurestclientapi.ParsedResponse, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// OnStatus is true if the attempt received a response with one of the given status codes.
+func OnStatus(statuses ...int) aurestclientapi.RetryConditionCallback {
+	return func(_ context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+		if response == nil {
+			return false
+		}
+		for _, s := range statuses {
+			if response.Status == s {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// On5xx is true if the attempt received a response with a 5xx status code.
+func On5xx(_ context.Context, response *aurestclientapi.ParsedResponse, _ error) bool {
+	return response != nil && response.Status >= 500 && response.Status <= 599
+}
+
+// OnTooManyRequests is true if the attempt received a 429 response.
+func OnTooManyRequests(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+	return OnStatus(http.StatusTooManyRequests)(ctx, response, err)
+}
+
+// NeverOnNonTripping is false if the attempt failed with a non-tripping error, true otherwise.
+//
+// Non-tripping errors such as a response body that cannot be parsed will not go away on retry.
+func NeverOnNonTripping(_ context.Context, _ *aurestclientapi.ParsedResponse, err error) bool {
+	return !aurestnontripping.Is(err)
+}
+
+// NotCancelled is false once the context is done, because any further attempt would fail immediately.
+func NotCancelled(ctx context.Context, _ *aurestclientapi.ParsedResponse, _ error) bool {
+	return ctx.Err() == nil
+}
+
+// IdempotentMethodsOnly is true only for requests with an idempotent method (GET, HEAD, OPTIONS, TRACE,
+// PUT, DELETE), which can safely be sent more than once.
+//
+// Only works inside a RetryImpl, which makes the method available to its conditions.
+func IdempotentMethodsOnly(ctx context.Context, _ *aurestclientapi.ParsedResponse, _ error) bool {
+	switch requestFromContext(ctx).method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// And is true if all conditions are true.
+func And(conditions ...aurestclientapi.RetryConditionCallback) aurestclientapi.RetryConditionCallback {
+	return func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+		for _, c := range conditions {
+			if !c(ctx, response, err) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or is true if any of the conditions is true.
+func Or(conditions ...aurestclientapi.RetryConditionCallback) aurestclientapi.RetryConditionCallback {
+	return func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+		for _, c := range conditions {
+			if c(ctx, response, err) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not negates a condition.
+func Not(condition aurestclientapi.RetryConditionCallback) aurestclientapi.RetryConditionCallback {
+	return func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+		return !condition(ctx, response, err)
+	}
+}
@@ -0,0 +1,77 @@
+package aurestretry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type tstTimeoutError struct{}
+
+func (e tstTimeoutError) Error() string   { return "i/o timeout" }
+func (e tstTimeoutError) Timeout() bool   { return true }
+func (e tstTimeoutError) Temporary() bool { return true }
+
+func TestConditions(t *testing.T) {
+	ctx := contextWithRequest(context.Background(), "GET")
+	status := func(s int) *aurestclientapi.ParsedResponse {
+		return &aurestclientapi.ParsedResponse{Status: s}
+	}
+	transportErr := errors.New("some transport error")
+	nonTrippingErr := aurestnontripping.New(ctx, errors.New("invalid json"))
+	timeoutErr := fmt.Errorf("url.Error received on http request: %w", tstTimeoutError{})
+
+	require.True(t, OnNetworkError(ctx, status(0), transportErr))
+	require.False(t, OnNetworkError(ctx, status(0), nonTrippingErr))
+	require.False(t, OnNetworkError(ctx, status(0), fmt.Errorf("wrapped: %w", context.Canceled)))
+	require.False(t, OnNetworkError(ctx, status(500), nil))
+
+	require.True(t, OnTimeout(ctx, status(0), timeoutErr))
+	require.True(t, OnTimeout(ctx, status(0), context.DeadlineExceeded))
+	require.False(t, OnTimeout(ctx, status(0), transportErr))
+
+	require.True(t, OnStatus(502, 503)(ctx, status(503), nil))
+	require.False(t, OnStatus(502, 503)(ctx, status(500), nil))
+	require.True(t, On5xx(ctx, status(500), nil))
+	require.False(t, On5xx(ctx, status(404), nil))
+	require.True(t, OnTooManyRequests(ctx, status(429), nil))
+
+	require.False(t, NeverOnNonTripping(ctx, status(200), nonTrippingErr))
+	require.True(t, NeverOnNonTripping(ctx, status(200), transportErr))
+
+	require.True(t, IdempotentMethodsOnly(ctx, status(500), nil))
+	require.False(t, IdempotentMethodsOnly(contextWithRequest(context.Background(), "POST"), status(500), nil))
+	require.False(t, IdempotentMethodsOnly(context.Background(), status(500), nil))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.False(t, NotCancelled(cancelled, status(500), nil))
+	require.False(t, DefaultCondition()(cancelled, status(503), nil))
+
+	require.True(t, And(On5xx, Not(OnStatus(501)))(ctx, status(500), nil))
+	require.False(t, And(On5xx, Not(OnStatus(501)))(ctx, status(501), nil))
+	require.True(t, Or(OnTooManyRequests, On5xx)(ctx, status(429), nil))
+	require.False(t, Or(OnTooManyRequests, On5xx)(ctx, status(400), nil))
+}
+
+func TestDefaultConditionDoesNotRetryPost(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := New(mock, 2, DefaultCondition(), nil)
+
+	err := cut.Perform(context.Background(), "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	r := "GET http://err <nil>"
+	require.Equal(t, []string{r, r, r}, aurestcapture.GetRecording(mock))
+
+	aurestcapture.ResetRecording(mock)
+	_ = cut.Perform(context.Background(), "POST", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, 1, len(aurestcapture.GetRecording(mock)))
+}
@@ -0,0 +1,38 @@
+package aurestretry
+
+import (
+	"context"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+)
+
+type requestKeyType struct{}
+
+var requestKey = requestKeyType{}
+
+// requestInfo is placed in the context by RetryImpl, so conditions and callbacks can access it.
+type requestInfo struct {
+	method string
+}
+
+func contextWithRequest(ctx context.Context, method string) context.Context {
+	return context.WithValue(ctx, requestKey, requestInfo{
+		method: method,
+	})
+}
+
+func requestFromContext(ctx context.Context) requestInfo {
+	if info, ok := ctx.Value(requestKey).(requestInfo); ok {
+		return info
+	}
+	return requestInfo{}
+}
+
+// AttemptFromContext returns the number of the current attempt (1 for the first attempt, 2 for the first retry, ...)
+// if the request is made through a RetryImpl.
+//
+// Returns 0 if the context did not come from a RetryImpl.
+//
+// Same as aurestclientapi.AttemptFromContext, which layers that do not otherwise depend on the retry should use.
+func AttemptFromContext(ctx context.Context) uint8 {
+	return aurestclientapi.AttemptFromContext(ctx)
+}
@@ -0,0 +1,112 @@
+package aurestretry
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func tstAlwaysRetry(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+	return true
+}
+
+func TestRetrySkippedWhenDeadlineTooClose(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := NewWithOptions(mock, tstAlwaysRetry, RetryOptions{
+		RepeatCount:             3,
+		ExpectedAttemptDuration: time.Second,
+		SilenceGivingUp:         true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := cut.Perform(ctx, "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	require.Equal(t, "some transport error", err.Error())
+	require.Equal(t, []string{"GET http://err <nil>"}, aurestcapture.GetRecording(mock))
+}
+
+func TestRetrySkippedWhenCancelled(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := tstMock()
+	cut := NewWithOptions(mock, tstAlwaysRetry, RetryOptions{
+		RepeatCount:     3,
+		SilenceGivingUp: true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var givingUpErr error
+	Instrument(cut, nil, func(ctx context.Context, method string, url string, status int, err error, latency time.Duration, size int) {
+		givingUpErr = err
+	})
+
+	// like running out of attempts, the result of the last attempt is returned
+	err := cut.Perform(ctx, "GET", "http://ok", nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"GET http://ok <nil>"}, aurestcapture.GetRecording(mock))
+	require.True(t, errors.Is(givingUpErr, ErrInsufficientTime))
+	require.True(t, errors.Is(givingUpErr, context.Canceled))
+}
+
+// deadlineRecordingClient records the time remaining until the deadline of each attempt and always fails
+type deadlineRecordingClient struct {
+	remaining []time.Duration
+}
+
+func (c *deadlineRecordingClient) Perform(ctx context.Context, _ string, _ string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	deadline, ok := ctx.Deadline()
+	if ok {
+		c.remaining = append(c.remaining, time.Until(deadline))
+	} else {
+		c.remaining = append(c.remaining, 0)
+	}
+	return errors.New("some transport error")
+}
+
+func TestSplitDeadlineAcrossAttempts(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &deadlineRecordingClient{}
+	cut := NewWithOptions(recorder, tstAlwaysRetry, RetryOptions{
+		RepeatCount:                 1,
+		ExpectedAttemptDuration:     time.Millisecond,
+		SplitDeadlineAcrossAttempts: true,
+		SilenceGivingUp:             true,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = cut.Perform(ctx, "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, 2, len(recorder.remaining))
+	require.InDelta(t, float64(5*time.Second), float64(recorder.remaining[0]), float64(100*time.Millisecond))
+	require.InDelta(t, float64(10*time.Second), float64(recorder.remaining[1]), float64(100*time.Millisecond))
+}
+
+func TestPerAttemptTimeout(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &deadlineRecordingClient{}
+	cut := NewWithOptions(recorder, tstAlwaysRetry, RetryOptions{
+		RepeatCount:       1,
+		PerAttemptTimeout: time.Second,
+		SilenceGivingUp:   true,
+	})
+
+	_ = cut.Perform(context.Background(), "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, 2, len(recorder.remaining))
+	for _, r := range recorder.remaining {
+		require.InDelta(t, float64(time.Second), float64(r), float64(100*time.Millisecond))
+	}
+}
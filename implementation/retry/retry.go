@@ -2,17 +2,94 @@ package aurestretry
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestbodyreplay "github.com/StephanHCB/go-autumn-restclient/implementation/internal/bodyreplay"
+	aurestresponsecopy "github.com/StephanHCB/go-autumn-restclient/implementation/internal/responsecopy"
+	aurestredaction "github.com/StephanHCB/go-autumn-restclient/implementation/redaction"
+	"strconv"
 	"time"
 )
 
+// ErrInsufficientTime is passed (wrapped) to the giving up metrics callback and logged if a retry is skipped
+// because the context is done or there is not enough time left until its deadline.
+//
+// Perform then returns the error of the last attempt (which may be nil), just as if all attempts were used up.
+var ErrInsufficientTime = errors.New("not enough time left for another attempt")
+
+// contextDoneError reports that a retry was skipped because the context was already done.
+//
+// It matches both ErrInsufficientTime and the context error with errors.Is.
+type contextDoneError struct {
+	cause error
+}
+
+func (e *contextDoneError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInsufficientTime.Error(), e.cause.Error())
+}
+
+func (e *contextDoneError) Is(target error) bool {
+	return target == ErrInsufficientTime
+}
+
+func (e *contextDoneError) Unwrap() error {
+	return e.cause
+}
+
 type RetryOptions struct {
 	RepeatCount uint8
 
 	BeforeRetryOrNil aurestclientapi.BeforeRetryCallback
 
 	SilenceGivingUp bool
+
+	// BackoffOrNil determines the delay between attempts. nil means retry immediately.
+	//
+	// See ConstantBackoff, LinearBackoff, ExponentialBackoff and DecorrelatedJitterBackoff.
+	BackoffOrNil BackoffFunction
+
+	// HonourRetryAfter makes the retry wait as requested by the Retry-After header of 429 and 503 responses.
+	//
+	// If the requested wait does not fit before the context deadline, the retry gives up right away
+	// with a *RetryAfterExceedsDeadlineError.
+	HonourRetryAfter bool
+	// MaxRetryAfter caps the wait requested by a Retry-After header. 0 means no cap.
+	MaxRetryAfter time.Duration
+
+	// MaxBufferedBodySize limits how many bytes of an aurestclientapi.CustomRequestBody are buffered in memory
+	// so the body can be sent again on retry. Only used if the BodyReader is not an io.Seeker and there is
+	// no GetBody function.
+	//
+	// 0 means DefaultMaxBufferedBodySize, a negative value disables buffering.
+	MaxBufferedBodySize int
+
+	// ExpectedAttemptDuration is how long an attempt is expected to take. A retry is skipped if it cannot
+	// complete before the context deadline.
+	//
+	// 0 means use the observed duration of the previous attempt.
+	ExpectedAttemptDuration time.Duration
+
+	// PerAttemptTimeout gives each attempt its own timeout, so a single hanging attempt cannot use up the
+	// time available for retries. 0 means no per attempt timeout.
+	PerAttemptTimeout time.Duration
+
+	// SplitDeadlineAcrossAttempts gives each attempt an equal share of the time remaining until the context
+	// deadline (the remaining time divided by the number of remaining attempts). Combines with PerAttemptTimeout,
+	// the shorter timeout wins.
+	SplitDeadlineAcrossAttempts bool
+
+	// RetryBudgetOrNil limits the number of retries across all requests. Share it between RetryImpl instances
+	// to limit them together. nil means no limit.
+	RetryBudgetOrNil *RetryBudget
+
+	// AttemptHeaderName, if set, makes the http client send the attempt number (1 for the first attempt)
+	// in a request header of this name, e.g. "X-Retry-Attempt".
+	AttemptHeaderName string
+
+	// RedactorOrNil masks secrets in urls and errors in log messages. Defaults to aurestredaction.Default().
+	RedactorOrNil *aurestredaction.Redactor
 }
 
 type RetryImpl struct {
@@ -26,6 +103,30 @@ type RetryImpl struct {
 	GivingUpMetricsCallback aurestclientapi.MetricsCallbackFunction
 
 	SilenceGivingUp bool
+
+	Backoff BackoffFunction
+	// Sleep is exposed so tests can avoid actually waiting by overwriting this field
+	Sleep SleepFunction
+
+	HonourRetryAfter bool
+	MaxRetryAfter    time.Duration
+
+	MaxBufferedBodySize int
+
+	ExpectedAttemptDuration     time.Duration
+	PerAttemptTimeout           time.Duration
+	SplitDeadlineAcrossAttempts bool
+
+	RetryBudget                      *RetryBudget
+	RetryBudgetDeniedMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	AttemptHeaderName string
+
+	// Redactor masks secrets in urls and errors in log messages. nil uses aurestredaction.Default().
+	Redactor *aurestredaction.Redactor
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
 }
 
 func NewWithOptions(
@@ -37,6 +138,10 @@ func NewWithOptions(
 	if opts.RepeatCount > 0 {
 		repeatCount = opts.RepeatCount
 	}
+	maxBufferedBodySize := DefaultMaxBufferedBodySize
+	if opts.MaxBufferedBodySize != 0 {
+		maxBufferedBodySize = opts.MaxBufferedBodySize
+	}
 	return &RetryImpl{
 		Wrapped:                 wrapped,
 		RepeatCount:             repeatCount,
@@ -45,6 +150,23 @@ func NewWithOptions(
 		RetryingMetricsCallback: doNothingMetricsCallback,
 		GivingUpMetricsCallback: doNothingMetricsCallback,
 		SilenceGivingUp:         opts.SilenceGivingUp,
+		Backoff:                 opts.BackoffOrNil,
+		Sleep:                   contextSleep,
+		HonourRetryAfter:        opts.HonourRetryAfter,
+		MaxRetryAfter:           opts.MaxRetryAfter,
+		MaxBufferedBodySize:     maxBufferedBodySize,
+
+		ExpectedAttemptDuration:     opts.ExpectedAttemptDuration,
+		PerAttemptTimeout:           opts.PerAttemptTimeout,
+		SplitDeadlineAcrossAttempts: opts.SplitDeadlineAcrossAttempts,
+
+		RetryBudget:                      opts.RetryBudgetOrNil,
+		RetryBudgetDeniedMetricsCallback: doNothingMetricsCallback,
+
+		AttemptHeaderName: opts.AttemptHeaderName,
+		Redactor:          opts.RedactorOrNil,
+
+		Now: time.Now,
 	}
 }
 
@@ -61,6 +183,12 @@ func New(
 		BeforeRetry:             beforeRetryOrNil,
 		RetryingMetricsCallback: doNothingMetricsCallback,
 		GivingUpMetricsCallback: doNothingMetricsCallback,
+		Sleep:                   contextSleep,
+		MaxBufferedBodySize:     DefaultMaxBufferedBodySize,
+
+		RetryBudgetDeniedMetricsCallback: doNothingMetricsCallback,
+
+		Now: time.Now,
 	}
 }
 
@@ -85,41 +213,252 @@ func Instrument(
 	}
 }
 
+// InstrumentRetryBudget adds a callback that is invoked when a retry is denied by the RetryBudget.
+//
+// The callback may be nil.
+func InstrumentRetryBudget(
+	client aurestclientapi.Client,
+	retryBudgetDeniedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	retryingClient, ok := client.(*RetryImpl)
+	if !ok {
+		return
+	}
+
+	if retryBudgetDeniedMetricsCallback != nil {
+		retryingClient.RetryBudgetDeniedMetricsCallback = retryBudgetDeniedMetricsCallback
+	}
+}
+
 func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
 
 }
 
 func (c *RetryImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	ctx = contextWithRequest(ctx, method)
+	lastResponse, err := c.performAttempts(ctx, method, requestUrl, requestBody, response)
+	if lastResponse != response {
+		aurestresponsecopy.CopyInto(response, lastResponse)
+	}
+	return err
+}
+
+// performAttempts makes the attempts and returns the response of the last one.
+//
+// If retries are possible, each attempt decodes into its own response, so a failed attempt cannot
+// leave any of its data in the final result. Callbacks see the response of the current attempt.
+func (c *RetryImpl) performAttempts(ctx context.Context, method string, requestUrl string, requestBody interface{}, finalResponse *aurestclientapi.ParsedResponse) (*aurestclientapi.ParsedResponse, error) {
 	var attempt uint8
 	var err error
+	var backoffDelay time.Duration
+	var delay time.Duration
+
+	var replayer *aurestbodyreplay.Replayer
+	if c.RepeatCount > 0 {
+		replayer, err = aurestbodyreplay.New(ctx, requestBody, c.MaxBufferedBodySize)
+		if err != nil {
+			return finalResponse, err
+		}
+	}
+
+	// log messages use the shared redactor, the caller still gets the original errors
+	redactor := aurestredaction.Use(c.Redactor)
+
+	response := finalResponse
 	for attempt = 1; attempt <= c.RepeatCount+1; attempt++ {
-		err = c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+		// the attempt number is available to everything below us, and to our callbacks
+		ctx := c.contextWithAttempt(ctx, attempt)
+
+		attemptBody := requestBody
+		if replayer != nil {
+			var err2 error
+			attemptBody, err2 = replayer.BodyFor(ctx, int(attempt))
+			if err2 != nil {
+				c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err2, 0, 0)
+				aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err2, requestUrl)).Printf("giving up on %s %s before attempt %d", method, redactor.Url(requestUrl), attempt)
+				if err != nil {
+					aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err, requestUrl)).Printf("caused by original error (see error field)")
+				}
+				return response, err2
+			}
+		}
+
+		if c.RepeatCount > 0 {
+			response = aurestresponsecopy.NewLike(finalResponse)
+		}
+		attemptCtx, cancel := c.attemptContext(ctx, attempt)
+		attemptStart := c.now()
+		err = c.Wrapped.Perform(attemptCtx, method, requestUrl, attemptBody, response)
+		lastAttemptDuration := c.now().Sub(attemptStart)
+		cancel()
 
 		if c.RetryCondition(ctx, response, err) {
 			// (*)
 			if attempt == c.RepeatCount+1 {
 				c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err, 0, 0)
 				if !c.SilenceGivingUp {
-					aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("giving up on %s %s after attempt %d", method, requestUrl, attempt)
+					aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err, requestUrl)).Printf("giving up on %s %s after attempt %d", method, redactor.Url(requestUrl), attempt)
 				}
-				return err
+				return response, err
 			}
 		} else {
 			// no retry needed
-			return err
+			if err == nil && c.RetryBudget != nil {
+				c.RetryBudget.RecordSuccess()
+			}
+			return response, err
+		}
+
+		var err2 error
+		backoffDelay, delay, err2 = c.nextDelay(ctx, attempt, backoffDelay, response, err)
+		if err2 != nil {
+			c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err2, 0, 0)
+			if !c.SilenceGivingUp {
+				aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err2, requestUrl)).Printf("giving up on %s %s after attempt %d", method, redactor.Url(requestUrl), attempt)
+			}
+			return response, err2
+		}
+
+		if err2 := c.checkTimeRemaining(ctx, delay, lastAttemptDuration); err2 != nil {
+			c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err2, 0, 0)
+			if !c.SilenceGivingUp {
+				aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err2, requestUrl)).Printf("giving up on %s %s after attempt %d", method, redactor.Url(requestUrl), attempt)
+			}
+			return response, err
+		}
+
+		if c.RetryBudget != nil && !c.RetryBudget.TryWithdraw() {
+			c.RetryBudgetDeniedMetricsCallback(ctx, method, requestUrl, response.Status, err, 0, 0)
+			c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err, 0, 0)
+			if !c.SilenceGivingUp {
+				aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err, requestUrl)).Printf("giving up on %s %s after attempt %d, retry budget exhausted", method, redactor.Url(requestUrl), attempt)
+			}
+			return response, err
 		}
 
 		if c.BeforeRetry != nil {
 			err2 := c.BeforeRetry(ctx, response, err)
 			if err2 != nil {
 				c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err2, 0, 0)
-				aulogging.Logger.Ctx(ctx).Warn().WithErr(err2).Printf("before retry callback failed for %s %s after attempt %d", method, requestUrl, attempt)
-				aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("caused by original error (see error field)")
-				return err2
+				aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err2, requestUrl)).Printf("before retry callback failed for %s %s after attempt %d", method, redactor.Url(requestUrl), attempt)
+				aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err, requestUrl)).Printf("caused by original error (see error field)")
+				return response, err2
 			}
 		}
 		c.RetryingMetricsCallback(ctx, method, requestUrl, response.Status, nil, 0, 0)
+
+		if delay > 0 {
+			if err2 := c.sleep(ctx, delay); err2 != nil {
+				c.GivingUpMetricsCallback(ctx, method, requestUrl, response.Status, err2, 0, 0)
+				if !c.SilenceGivingUp {
+					aulogging.Logger.Ctx(ctx).Warn().WithErr(redactor.Error(err2, requestUrl)).Printf("giving up on %s %s after attempt %d, context done while waiting %d ms before retry", method, redactor.Url(requestUrl), attempt, delay.Milliseconds())
+				}
+				if err == nil {
+					return response, err2
+				}
+				return response, err
+			}
+		}
 	}
 	// this line is actually unreachable, see (*) but go doesn't understand this
-	return err
+	return response, err
+}
+
+func (c *RetryImpl) sleep(ctx context.Context, duration time.Duration) error {
+	if c.Sleep == nil {
+		return contextSleep(ctx, duration)
+	}
+	return c.Sleep(ctx, duration)
+}
+
+// nextDelay determines how long to wait before the next attempt.
+//
+// Returns both the delay calculated by the Backoff, which is passed back in as previousBackoffDelay for the
+// next retry, and the effective delay, which may be longer because of a Retry-After header. Keeping them apart
+// ensures a Retry-After does not compound into all further backoff delays.
+//
+// Returns a *RetryAfterExceedsDeadlineError if the downstream requested a wait that cannot be honoured
+// before the context deadline.
+func (c *RetryImpl) nextDelay(ctx context.Context, attempt uint8, previousBackoffDelay time.Duration, response *aurestclientapi.ParsedResponse, originalErr error) (time.Duration, time.Duration, error) {
+	var backoffDelay time.Duration
+	if c.Backoff != nil {
+		backoffDelay = c.Backoff(attempt, previousBackoffDelay)
+	}
+	delay := backoffDelay
+
+	if c.HonourRetryAfter {
+		now := c.now()
+		if retryAfter, ok := parseRetryAfter(response, now); ok {
+			if c.MaxRetryAfter > 0 && retryAfter > c.MaxRetryAfter {
+				retryAfter = c.MaxRetryAfter
+			}
+			if deadline, hasDeadline := ctx.Deadline(); hasDeadline && now.Add(retryAfter).After(deadline) {
+				return backoffDelay, delay, &RetryAfterExceedsDeadlineError{
+					Status:     response.Status,
+					RetryAfter: retryAfter,
+					Remaining:  deadline.Sub(now),
+					Original:   originalErr,
+				}
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+	}
+	return backoffDelay, delay, nil
+}
+
+func (c *RetryImpl) contextWithAttempt(ctx context.Context, attempt uint8) context.Context {
+	ctx = aurestclientapi.ContextWithAttempt(ctx, attempt)
+	if c.AttemptHeaderName != "" {
+		ctx = aurestclientapi.ContextWithRequestHeader(ctx, c.AttemptHeaderName, strconv.Itoa(int(attempt)))
+	}
+	return ctx
+}
+
+// attemptContext derives the context for a single attempt, applying PerAttemptTimeout and SplitDeadlineAcrossAttempts.
+func (c *RetryImpl) attemptContext(ctx context.Context, attempt uint8) (context.Context, context.CancelFunc) {
+	timeout := c.PerAttemptTimeout
+	if c.SplitDeadlineAcrossAttempts {
+		if deadline, ok := ctx.Deadline(); ok {
+			remainingAttempts := time.Duration(c.RepeatCount) + 2 - time.Duration(attempt)
+			share := deadline.Sub(c.now()) / remainingAttempts
+			if timeout <= 0 || share < timeout {
+				timeout = share
+			}
+		}
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// checkTimeRemaining returns an error if the context is done, or if another attempt (after waiting for delay)
+// cannot be expected to complete before the context deadline.
+func (c *RetryImpl) checkTimeRemaining(ctx context.Context, delay time.Duration, lastAttemptDuration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return &contextDoneError{cause: err}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	expected := c.ExpectedAttemptDuration
+	if expected <= 0 {
+		expected = lastAttemptDuration
+	}
+	remaining := deadline.Sub(c.now())
+	if delay+expected > remaining {
+		return fmt.Errorf("%w: %d ms remaining, but need %d ms wait and expect attempt to take %d ms",
+			ErrInsufficientTime, remaining.Milliseconds(), delay.Milliseconds(), expected.Milliseconds())
+	}
+	return nil
+}
+
+func (c *RetryImpl) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/go-http-utils/headers"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func tstMock() aurestclientapi.Client {
@@ -167,3 +168,138 @@ func TestAbortRetry(t *testing.T) {
 	r := "GET http://err <nil>"
 	require.Equal(t, []string{r}, aurestcapture.GetRecording(mock))
 }
+
+type tstDto struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// flakyClient fails on the first attempt, after partially decoding an error body into the response
+type flakyClient struct {
+	attempts int
+}
+
+func (c *flakyClient) Perform(_ context.Context, _ string, _ string, _ interface{}, response *aurestclientapi.ParsedResponse) error {
+	c.attempts++
+	if c.attempts == 1 {
+		response.Status = 502
+		response.Header = map[string][]string{"X-Failed": {"true"}}
+		response.Body.(*tstDto).Error = "bad gateway"
+		return nil
+	}
+	response.Status = 200
+	response.Header = map[string][]string{}
+	response.Body.(*tstDto).Name = "kitty"
+	return nil
+}
+
+func TestFreshResponsePerAttempt(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	seenStatus := make([]int, 0)
+	cut := New(&flakyClient{}, 2,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			seenStatus = append(seenStatus, response.Status)
+			return response.Status != 200
+		},
+		func(ctx context.Context, originalResponse *aurestclientapi.ParsedResponse, originalError error) error {
+			require.Equal(t, "bad gateway", originalResponse.Body.(*tstDto).Error)
+			return nil
+		})
+
+	dto := tstDto{}
+	response := &aurestclientapi.ParsedResponse{
+		Body: &dto,
+	}
+	err := cut.Perform(context.Background(), "GET", "http://flaky", nil, response)
+	require.Nil(t, err)
+	require.Equal(t, []int{502, 200}, seenStatus)
+	require.Equal(t, 200, response.Status)
+	require.Equal(t, "", response.Header.Get("X-Failed"))
+	require.Equal(t, tstDto{Name: "kitty"}, dto)
+}
+
+func TestPrefilledBodyDefaultsAreKept(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	for _, failFirst := range []bool{false, true} {
+		client := &flakyClient{}
+		if !failFirst {
+			client.attempts = 1
+		}
+		cut := New(client, 2,
+			func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+				return response.Status != 200
+			}, nil)
+
+		dto := tstDto{Error: "default"}
+		err := cut.Perform(context.Background(), "GET", "http://flaky", nil, &aurestclientapi.ParsedResponse{
+			Body: &dto,
+		})
+		require.Nil(t, err)
+		// the failed attempt did not leave its data behind, but the default is still there
+		require.Equal(t, tstDto{Name: "kitty", Error: "default"}, dto)
+	}
+}
+
+// bodyTypeRecordingClient records the type of the response body it is asked to decode into
+type bodyTypeRecordingClient struct {
+	body interface{}
+}
+
+func (c *bodyTypeRecordingClient) Perform(_ context.Context, _ string, _ string, _ interface{}, response *aurestclientapi.ParsedResponse) error {
+	c.body = response.Body
+	response.Status = 200
+	return nil
+}
+
+func TestNonPointerBodyIsPassedOn(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	client := &bodyTypeRecordingClient{}
+	cut := New(client, 2, tstAlwaysRetry, nil)
+
+	// a body that is not a pointer cannot be decoded into, so the http client must see it and report that
+	_ = cut.Perform(context.Background(), "GET", "http://ok", nil, &aurestclientapi.ParsedResponse{
+		Body: tstDto{Name: "value"},
+	})
+	require.Equal(t, tstDto{Name: "value"}, client.body)
+}
+
+// attemptRecordingClient records the attempt number and attempt header seen in the context, and always fails
+type attemptRecordingClient struct {
+	attempts []uint8
+	headers  []string
+}
+
+func (c *attemptRecordingClient) Perform(ctx context.Context, _ string, _ string, _ interface{}, _ *aurestclientapi.ParsedResponse) error {
+	c.attempts = append(c.attempts, AttemptFromContext(ctx))
+	c.headers = append(c.headers, aurestclientapi.RequestHeadersFromContext(ctx).Get("X-Retry-Attempt"))
+	return errors.New("some transport error")
+}
+
+func TestAttemptInContext(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	recorder := &attemptRecordingClient{}
+	retrying := make([]uint8, 0)
+	cut := NewWithOptions(recorder,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			return true
+		},
+		RetryOptions{
+			RepeatCount:       2,
+			SilenceGivingUp:   true,
+			AttemptHeaderName: "X-Retry-Attempt",
+		},
+	)
+	Instrument(cut, func(ctx context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+		retrying = append(retrying, AttemptFromContext(ctx))
+	}, nil)
+
+	_ = cut.Perform(context.Background(), "GET", "http://err", nil, &aurestclientapi.ParsedResponse{})
+	require.Equal(t, []uint8{1, 2, 3}, recorder.attempts)
+	require.Equal(t, []string{"1", "2", "3"}, recorder.headers)
+	require.Equal(t, []uint8{1, 2}, retrying)
+	require.Equal(t, uint8(0), AttemptFromContext(context.Background()))
+}
@@ -0,0 +1,58 @@
+package aurestretry
+
+import (
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryAfterExceedsDeadlineError is returned when the downstream asked us to wait (using a Retry-After header)
+// longer than the time remaining until the context deadline.
+//
+// There is no point in waiting, because the retry would fail anyway.
+type RetryAfterExceedsDeadlineError struct {
+	Status     int
+	RetryAfter time.Duration
+	Remaining  time.Duration
+	// Original is the error returned by the last attempt, may be nil
+	Original error
+}
+
+func (e *RetryAfterExceedsDeadlineError) Error() string {
+	return fmt.Sprintf("downstream responded %d with Retry-After %d ms, but only %d ms remain until the context deadline",
+		e.Status, e.RetryAfter.Milliseconds(), e.Remaining.Milliseconds())
+}
+
+func (e *RetryAfterExceedsDeadlineError) Unwrap() error {
+	return e.Original
+}
+
+// parseRetryAfter obtains the requested wait from the Retry-After header of a 429 or 503 response.
+//
+// Both forms are supported, delta-seconds and http-date.
+func parseRetryAfter(response *aurestclientapi.ParsedResponse, now time.Time) (time.Duration, bool) {
+	if response == nil || (response.Status != http.StatusTooManyRequests && response.Status != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := strings.TrimSpace(response.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		wait := at.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,135 @@
+package aurestretry
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcapture "github.com/StephanHCB/go-autumn-restclient/implementation/capture"
+	aurestmock "github.com/StephanHCB/go-autumn-restclient/implementation/mock"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func tstRetryAfterMock(retryAfter string) aurestclientapi.Client {
+	return aurestcapture.New(aurestmock.New(
+		map[string]aurestclientapi.ParsedResponse{
+			"GET http://busy <nil>": {
+				Status: http.StatusServiceUnavailable,
+				Header: http.Header{
+					"Retry-After": []string{retryAfter},
+				},
+			},
+		},
+		map[string]error{},
+	))
+}
+
+func tstRetryAfterCut(mock aurestclientapi.Client, now time.Time, sleeps *[]time.Duration) aurestclientapi.Client {
+	cut := NewWithOptions(mock,
+		func(ctx context.Context, response *aurestclientapi.ParsedResponse, err error) bool {
+			return response.Status == http.StatusServiceUnavailable
+		},
+		RetryOptions{
+			RepeatCount:      1,
+			HonourRetryAfter: true,
+			MaxRetryAfter:    time.Minute,
+			SilenceGivingUp:  true,
+		},
+	)
+	cut.(*RetryImpl).Now = func() time.Time {
+		return now
+	}
+	cut.(*RetryImpl).Sleep = func(ctx context.Context, duration time.Duration) error {
+		*sleeps = append(*sleeps, duration)
+		return nil
+	}
+	return cut
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	response := func(status int, value string) *aurestclientapi.ParsedResponse {
+		return &aurestclientapi.ParsedResponse{
+			Status: status,
+			Header: http.Header{"Retry-After": []string{value}},
+		}
+	}
+
+	d, ok := parseRetryAfter(response(429, "120"), now)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Minute, d)
+
+	d, ok = parseRetryAfter(response(503, "Sat, 01 Jan 2022 12:00:30 GMT"), now)
+	require.True(t, ok)
+	require.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter(response(500, "120"), now)
+	require.False(t, ok)
+
+	_, ok = parseRetryAfter(response(429, "soon"), now)
+	require.False(t, ok)
+}
+
+func TestRetryAfterIsHonoured(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	sleeps := make([]time.Duration, 0)
+	mock := tstRetryAfterMock("5")
+	cut := tstRetryAfterCut(mock, time.Now(), &sleeps)
+
+	err := cut.Perform(context.Background(), "GET", "http://busy", nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+	require.Equal(t, []time.Duration{5 * time.Second}, sleeps)
+	require.Equal(t, 2, len(aurestcapture.GetRecording(mock)))
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	sleeps := make([]time.Duration, 0)
+	mock := tstRetryAfterMock("3600")
+	cut := tstRetryAfterCut(mock, time.Now(), &sleeps)
+
+	err := cut.Perform(context.Background(), "GET", "http://busy", nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+	require.Equal(t, []time.Duration{time.Minute}, sleeps)
+}
+
+func TestRetryAfterExceedsDeadline(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	sleeps := make([]time.Duration, 0)
+	mock := tstRetryAfterMock("30")
+	now := time.Now()
+	cut := tstRetryAfterCut(mock, now, &sleeps)
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(10*time.Second))
+	defer cancel()
+
+	err := cut.Perform(ctx, "GET", "http://busy", nil, &aurestclientapi.ParsedResponse{})
+	require.NotNil(t, err)
+	var deadlineErr *RetryAfterExceedsDeadlineError
+	require.True(t, errors.As(err, &deadlineErr))
+	require.Equal(t, 30*time.Second, deadlineErr.RetryAfter)
+	require.Equal(t, 10*time.Second, deadlineErr.Remaining)
+	require.Equal(t, 0, len(sleeps))
+	require.Equal(t, 1, len(aurestcapture.GetRecording(mock)))
+}
+
+func TestRetryAfterDoesNotCompoundBackoff(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	sleeps := make([]time.Duration, 0)
+	mock := tstRetryAfterMock("5")
+	cut := tstRetryAfterCut(mock, time.Now(), &sleeps)
+	cut.(*RetryImpl).RepeatCount = 3
+	cut.(*RetryImpl).Backoff = ExponentialBackoff(100*time.Millisecond, 2, 0)
+
+	err := cut.Perform(context.Background(), "GET", "http://busy", nil, &aurestclientapi.ParsedResponse{})
+	require.Nil(t, err)
+	require.Equal(t, []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}, sleeps)
+	require.Equal(t, 4, len(aurestcapture.GetRecording(mock)))
+}
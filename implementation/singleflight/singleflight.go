@@ -0,0 +1,219 @@
+package aurestsingleflight
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestcaching "github.com/StephanHCB/go-autumn-restclient/implementation/caching"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	aurestdetachedcontext "github.com/StephanHCB/go-autumn-restclient/implementation/internal/detachedcontext"
+	aurestresponsecopy "github.com/StephanHCB/go-autumn-restclient/implementation/internal/responsecopy"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DedupConditionCallback determines whether identical requests may be merged. Only return true for
+// idempotent requests.
+type DedupConditionCallback func(ctx context.Context, method string, requestUrl string, requestBody interface{}) bool
+
+type SingleflightOptions struct {
+	// DedupConditionOrNil determines which requests are merged. Defaults to GET and HEAD requests.
+	DedupConditionOrNil DedupConditionCallback
+
+	// KeyFunctionOrNil determines which requests are identical. Defaults to aurestcaching.BodyAwareKeyFunction.
+	//
+	// Requests are only merged if they also carry the same headers from aurestclientapi.ContextWithRequestHeader.
+	// If your RequestManipulatorCallback sets credentials from other context values, the key must cover them,
+	// or callers will receive responses meant for someone else.
+	KeyFunctionOrNil aurestclientapi.CacheKeyFunction
+}
+
+// SingleflightImpl merges concurrent identical requests into a single downstream request.
+//
+// Unlike aurestcaching, nothing is kept once the request has completed, so a request that starts after
+// that goes downstream again.
+type SingleflightImpl struct {
+	Wrapped aurestclientapi.Client
+
+	DedupCondition DedupConditionCallback
+	KeyFunction    aurestclientapi.CacheKeyFunction
+
+	SharedMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done    chan struct{}
+	waiters int
+	cancel  context.CancelFunc
+
+	// set before done is closed
+	status   int
+	header   http.Header
+	time     time.Time
+	bodyJson []byte
+	err      error
+}
+
+// New builds a layer that merges concurrent identical GET and HEAD requests.
+//
+// Every waiting caller gets its own copy of the response, decoded into the Body it supplied.
+// The shared request runs with the context values of the request that started it, and is only cancelled
+// once all waiting callers have given up.
+//
+// Requests are identical if they have the same method, url, request body and headers added via
+// aurestclientapi.ContextWithRequestHeader. Other context values are ignored. If your
+// RequestManipulatorCallback adds authorization based on the context (e.g. to forward the caller's token),
+// use NewWithOptions with a KeyFunctionOrNil that includes the caller identity, or callers will receive
+// responses meant for someone else.
+func New(wrapped aurestclientapi.Client) aurestclientapi.Client {
+	return NewWithOptions(wrapped, SingleflightOptions{})
+}
+
+// NewWithOptions builds a request deduplication layer with more control, see SingleflightOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts SingleflightOptions) aurestclientapi.Client {
+	instance := &SingleflightImpl{
+		Wrapped:               wrapped,
+		DedupCondition:        defaultDedupCondition,
+		KeyFunction:           aurestcaching.BodyAwareKeyFunction,
+		SharedMetricsCallback: doNothingMetricsCallback,
+		calls:                 make(map[string]*call),
+	}
+	if opts.DedupConditionOrNil != nil {
+		instance.DedupCondition = opts.DedupConditionOrNil
+	}
+	if opts.KeyFunctionOrNil != nil {
+		instance.KeyFunction = opts.KeyFunctionOrNil
+	}
+	return instance
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// sharedMetricsCallback is called for each request that joins an identical request already in flight.
+//
+// The callback may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	sharedMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	singleflightClient, ok := client.(*SingleflightImpl)
+	if !ok {
+		return
+	}
+
+	if sharedMetricsCallback != nil {
+		singleflightClient.SharedMetricsCallback = sharedMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func defaultDedupCondition(_ context.Context, method string, _ string, _ interface{}) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// headersKey encodes the request headers from the context. The encoding is stable because json sorts map keys.
+func headersKey(ctx context.Context) string {
+	headers := aurestclientapi.RequestHeadersFromContext(ctx)
+	if len(headers) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(headers)
+	return string(encoded)
+}
+
+func (c *SingleflightImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	if !c.DedupCondition(ctx, method, requestUrl, requestBody) {
+		return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	}
+
+	// callers decoding into different types or sending different headers cannot share a response
+	key := fmt.Sprintf("%s %T %s", c.KeyFunction(ctx, method, requestUrl, requestBody), response.Body, headersKey(ctx))
+
+	c.mu.Lock()
+	cl, shared := c.calls[key]
+	if !shared {
+		sharedCtx, cancel := context.WithCancel(aurestdetachedcontext.Detach(ctx))
+		cl = &call{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.calls[key] = cl
+		go c.run(sharedCtx, key, cl, method, requestUrl, requestBody, aurestresponsecopy.NewLike(response))
+	}
+	cl.waiters++
+	c.mu.Unlock()
+
+	if shared {
+		c.SharedMetricsCallback(ctx, method, requestUrl, 0, nil, 0, 0)
+	}
+
+	select {
+	case <-cl.done:
+		return cl.deliver(ctx, response)
+	case <-ctx.Done():
+		c.leave(key, cl)
+		return ctx.Err()
+	}
+}
+
+func (c *SingleflightImpl) run(ctx context.Context, key string, cl *call, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) {
+	defer cl.cancel()
+
+	cl.err = c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	cl.status = response.Status
+	cl.header = response.Header
+	cl.time = response.Time
+	if response.Body != nil {
+		bodyJson, err := json.Marshal(response.Body)
+		if err == nil {
+			cl.bodyJson = bodyJson
+		} else if cl.err == nil {
+			cl.err = aurestnontripping.New(ctx, fmt.Errorf("failed to share response body: %w", err))
+		}
+	}
+
+	c.mu.Lock()
+	if c.calls[key] == cl {
+		delete(c.calls, key)
+	}
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+// leave is called when a waiting caller gives up. Once the last one has left, the shared request is cancelled.
+func (c *SingleflightImpl) leave(key string, cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl.waiters--
+	if cl.waiters == 0 {
+		cl.cancel()
+		if c.calls[key] == cl {
+			// nobody may join a cancelled request
+			delete(c.calls, key)
+		}
+	}
+}
+
+// deliver gives the caller its own copy of the shared response.
+//
+// Failing to copy the body is a local problem, so it is reported as a non-tripping error, just like decoding
+// errors in the http client.
+func (cl *call) deliver(ctx context.Context, response *aurestclientapi.ParsedResponse) error {
+	response.Status = cl.status
+	response.Header = cl.header.Clone()
+	response.Time = cl.time
+	if response.Body != nil && cl.bodyJson != nil {
+		if err := json.Unmarshal(cl.bodyJson, response.Body); err != nil && cl.err == nil {
+			return aurestnontripping.New(ctx, fmt.Errorf("failed to copy shared response body: %w", err))
+		}
+	}
+	return cl.err
+}
@@ -0,0 +1,186 @@
+package aurestsingleflight
+
+import (
+	"context"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	aurestnontripping "github.com/StephanHCB/go-autumn-restclient/implementation/errors/nontrippingerror"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type tstBody struct {
+	Name string `json:"name"`
+}
+
+// gatedClient holds all requests until the gate is opened, and counts them.
+type gatedClient struct {
+	gate      chan struct{}
+	requests  int32
+	cancelled int32
+}
+
+func (c *gatedClient) Perform(ctx context.Context, _ string, requestUrl string, _ interface{}, response *aurestclientapi.ParsedResponse) error {
+	atomic.AddInt32(&c.requests, 1)
+	select {
+	case <-c.gate:
+	case <-ctx.Done():
+		atomic.AddInt32(&c.cancelled, 1)
+		return ctx.Err()
+	}
+	response.Status = 200
+	response.Header = http.Header{"X-Test": []string{"yes"}}
+	if body, ok := response.Body.(*tstBody); ok {
+		body.Name = requestUrl
+	}
+	return nil
+}
+
+func tstWaitForJoined(t *testing.T, cut *SingleflightImpl, waiters int) {
+	require.Eventually(t, func() bool {
+		cut.mu.Lock()
+		defer cut.mu.Unlock()
+		for _, cl := range cut.calls {
+			if cl.waiters == waiters {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+}
+
+func TestMergesConcurrentRequests(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &gatedClient{gate: make(chan struct{})}
+	cut := New(mock).(*SingleflightImpl)
+	var shared int32
+	Instrument(cut, func(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+		atomic.AddInt32(&shared, 1)
+	})
+
+	responses := make([]*aurestclientapi.ParsedResponse, 5)
+	errs := make([]error, 5)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = &aurestclientapi.ParsedResponse{Body: &tstBody{}}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cut.Perform(context.Background(), "GET", "http://a/1?y=2&x=1", nil, responses[i])
+		}(i)
+	}
+	tstWaitForJoined(t, cut, 5)
+	close(mock.gate)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&mock.requests))
+	require.Equal(t, int32(4), atomic.LoadInt32(&shared))
+	for i := range responses {
+		require.Nil(t, errs[i])
+		require.Equal(t, 200, responses[i].Status)
+		require.Equal(t, "yes", responses[i].Header.Get("X-Test"))
+		require.Equal(t, &tstBody{Name: "http://a/1?y=2&x=1"}, responses[i].Body)
+	}
+	// every caller has its own copy
+	responses[0].Body.(*tstBody).Name = "changed"
+	responses[0].Header.Set("X-Test", "changed")
+	require.Equal(t, "http://a/1?y=2&x=1", responses[1].Body.(*tstBody).Name)
+	require.Equal(t, "yes", responses[1].Header.Get("X-Test"))
+
+	// nothing is retained
+	require.Equal(t, 0, len(cut.calls))
+	require.Nil(t, cut.Perform(context.Background(), "GET", "http://a/1?x=1&y=2", nil, &aurestclientapi.ParsedResponse{Body: &tstBody{}}))
+	require.Equal(t, int32(2), atomic.LoadInt32(&mock.requests))
+}
+
+func TestDoesNotMergeOtherRequests(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &gatedClient{gate: make(chan struct{})}
+	close(mock.gate)
+	cut := New(mock)
+
+	require.Nil(t, cut.Perform(context.Background(), "POST", "http://a/1", nil, &aurestclientapi.ParsedResponse{}))
+	require.Nil(t, cut.Perform(context.Background(), "POST", "http://a/1", nil, &aurestclientapi.ParsedResponse{}))
+	require.Equal(t, int32(2), atomic.LoadInt32(&mock.requests))
+}
+
+func TestDoesNotMergeDifferentContextHeaders(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &gatedClient{gate: make(chan struct{})}
+	cut := New(mock).(*SingleflightImpl)
+
+	var wg sync.WaitGroup
+	for _, token := range []string{"Bearer alice", "Bearer bob"} {
+		ctx := aurestclientapi.ContextWithRequestHeader(context.Background(), "Authorization", token)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Nil(t, cut.Perform(ctx, "GET", "http://a/me", nil, &aurestclientapi.ParsedResponse{Body: &tstBody{}}))
+		}()
+	}
+	require.Eventually(t, func() bool {
+		cut.mu.Lock()
+		defer cut.mu.Unlock()
+		return len(cut.calls) == 2
+	}, time.Second, time.Millisecond)
+	close(mock.gate)
+	wg.Wait()
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&mock.requests))
+}
+
+func TestCancelOnlyWhenAllWaitersLeave(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &gatedClient{gate: make(chan struct{})}
+	cut := New(mock).(*SingleflightImpl)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	done1 := make(chan error)
+	done2 := make(chan error)
+	go func() {
+		done1 <- cut.Perform(ctx1, "GET", "http://a/1", nil, &aurestclientapi.ParsedResponse{Body: &tstBody{}})
+	}()
+	tstWaitForJoined(t, cut, 1)
+	go func() {
+		done2 <- cut.Perform(ctx2, "GET", "http://a/1", nil, &aurestclientapi.ParsedResponse{Body: &tstBody{}})
+	}()
+	tstWaitForJoined(t, cut, 2)
+
+	// the first caller giving up does not affect the second
+	cancel1()
+	require.Equal(t, context.Canceled, <-done1)
+	require.Equal(t, int32(0), atomic.LoadInt32(&mock.cancelled))
+
+	cancel2()
+	require.Equal(t, context.Canceled, <-done2)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&mock.cancelled) == 1
+	}, time.Second, time.Millisecond)
+
+	cut.mu.Lock()
+	defer cut.mu.Unlock()
+	require.Equal(t, 0, len(cut.calls))
+}
+
+func TestBodyCopyErrorsAreNonTripping(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	mock := &gatedClient{gate: make(chan struct{})}
+	close(mock.gate)
+	cut := New(mock)
+
+	// a channel cannot be marshalled to json, so the response cannot be shared
+	var body chan int
+	err := cut.Perform(context.Background(), "GET", "http://a/1", nil, &aurestclientapi.ParsedResponse{Body: &body})
+	require.NotNil(t, err)
+	require.True(t, aurestnontripping.Is(err))
+}
@@ -0,0 +1,147 @@
+package auresttimeout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"regexp"
+	"time"
+)
+
+// Route assigns a timeout to all requests matching Method and UrlPattern.
+type Route struct {
+	// Method restricts the route to one http method. "" matches all methods.
+	Method string
+	// UrlPattern is matched against the complete request url. nil matches all urls.
+	UrlPattern *regexp.Regexp
+
+	Timeout time.Duration
+}
+
+type TimeoutOptions struct {
+	// DefaultTimeout applies to requests not matching any of the Routes. 0 means no timeout.
+	DefaultTimeout time.Duration
+
+	// Routes are checked in order, the first match determines the timeout.
+	Routes []Route
+}
+
+type TimeoutImpl struct {
+	Wrapped aurestclientapi.Client
+
+	DefaultTimeout time.Duration
+	Routes         []Route
+
+	TimeoutMetricsCallback aurestclientapi.MetricsCallbackFunction
+
+	// Now is exposed so tests can fixate the time by overwriting this field
+	Now func() time.Time
+}
+
+// TimeoutError is returned when a request did not complete within the timeout set by this layer.
+//
+// It wraps the error returned by the request, which will usually wrap context.DeadlineExceeded.
+// It is deliberately not a non-tripping error, timeouts should count for a circuit breaker.
+type TimeoutError struct {
+	Method     string
+	RequestUrl string
+	Timeout    time.Duration
+	Err        error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("downstream %s %s timed out after %s: %v", e.Method, e.RequestUrl, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout checks whether err is (or wraps) a *TimeoutError.
+func IsTimeout(err error) bool {
+	var timeoutError *TimeoutError
+	return errors.As(err, &timeoutError)
+}
+
+// New builds a timeout layer that gives each request the same timeout.
+//
+// Insert this into your stack below the circuit breaker, so it counts timeouts, and below the retry, so
+// each attempt gets the full timeout.
+func New(wrapped aurestclientapi.Client, timeout time.Duration) aurestclientapi.Client {
+	return NewWithOptions(wrapped, TimeoutOptions{
+		DefaultTimeout: timeout,
+	})
+}
+
+// NewWithOptions builds a timeout layer with per route timeouts, see TimeoutOptions.
+func NewWithOptions(wrapped aurestclientapi.Client, opts TimeoutOptions) aurestclientapi.Client {
+	return &TimeoutImpl{
+		Wrapped:                wrapped,
+		DefaultTimeout:         opts.DefaultTimeout,
+		Routes:                 opts.Routes,
+		TimeoutMetricsCallback: doNothingMetricsCallback,
+		Now:                    time.Now,
+	}
+}
+
+// Instrument adds instrumentation to a http client.
+//
+// timeoutMetricsCallback is called for each request that timed out, with the TimeoutError.
+//
+// The callback may be nil.
+func Instrument(
+	client aurestclientapi.Client,
+	timeoutMetricsCallback aurestclientapi.MetricsCallbackFunction,
+) {
+	timeoutClient, ok := client.(*TimeoutImpl)
+	if !ok {
+		return
+	}
+
+	if timeoutMetricsCallback != nil {
+		timeoutClient.TimeoutMetricsCallback = timeoutMetricsCallback
+	}
+}
+
+func doNothingMetricsCallback(_ context.Context, _ string, _ string, _ int, _ error, _ time.Duration, _ int) {
+
+}
+
+func (c *TimeoutImpl) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	timeout := c.TimeoutFor(method, requestUrl)
+	if timeout <= 0 {
+		return c.Wrapped.Perform(ctx, method, requestUrl, requestBody, response)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := c.Now()
+	err := c.Wrapped.Perform(timeoutCtx, method, requestUrl, requestBody, response)
+	if err != nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		// our deadline was hit, not one set by the caller
+		err = &TimeoutError{
+			Method:     method,
+			RequestUrl: requestUrl,
+			Timeout:    timeout,
+			Err:        err,
+		}
+		c.TimeoutMetricsCallback(ctx, method, requestUrl, 0, err, c.Now().Sub(start), 0)
+	}
+	return err
+}
+
+// TimeoutFor returns the timeout for a request, 0 meaning no timeout.
+func (c *TimeoutImpl) TimeoutFor(method string, requestUrl string) time.Duration {
+	for _, route := range c.Routes {
+		if route.Method != "" && route.Method != method {
+			continue
+		}
+		if route.UrlPattern != nil && !route.UrlPattern.MatchString(requestUrl) {
+			continue
+		}
+		return route.Timeout
+	}
+	return c.DefaultTimeout
+}
@@ -0,0 +1,83 @@
+package auresttimeout
+
+import (
+	"context"
+	"errors"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// slowClient takes delay to respond, unless the context is done first.
+type slowClient struct {
+	delay time.Duration
+}
+
+func (c *slowClient) Perform(ctx context.Context, _ string, _ string, _ interface{}, response *aurestclientapi.ParsedResponse) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.delay):
+		response.Status = 200
+		return nil
+	}
+}
+
+func TestTimeoutFor(t *testing.T) {
+	cut := NewWithOptions(&slowClient{}, TimeoutOptions{
+		DefaultTimeout: 5 * time.Second,
+		Routes: []Route{
+			{Method: "POST", UrlPattern: regexp.MustCompile(`/reports$`), Timeout: time.Minute},
+			{UrlPattern: regexp.MustCompile(`/reports$`), Timeout: 10 * time.Second},
+			{Method: "DELETE", Timeout: 0},
+		},
+	}).(*TimeoutImpl)
+
+	require.Equal(t, time.Minute, cut.TimeoutFor("POST", "http://a/reports"))
+	require.Equal(t, 10*time.Second, cut.TimeoutFor("GET", "http://a/reports"))
+	require.Equal(t, time.Duration(0), cut.TimeoutFor("DELETE", "http://a/items"))
+	require.Equal(t, 5*time.Second, cut.TimeoutFor("GET", "http://a/items"))
+}
+
+func TestTimesOut(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut := New(&slowClient{delay: time.Second}, 10*time.Millisecond)
+	timeouts := 0
+	Instrument(cut, func(_ context.Context, _ string, _ string, _ int, err error, _ time.Duration, _ int) {
+		require.True(t, IsTimeout(err))
+		timeouts++
+	})
+
+	err := cut.Perform(context.Background(), "GET", "http://a/items", nil, &aurestclientapi.ParsedResponse{})
+	require.True(t, IsTimeout(err))
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Equal(t, "downstream GET http://a/items timed out after 10ms: context deadline exceeded", err.Error())
+	require.Equal(t, 1, timeouts)
+}
+
+func TestNoTimeout(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut := New(&slowClient{delay: time.Millisecond}, time.Second)
+
+	response := &aurestclientapi.ParsedResponse{}
+	err := cut.Perform(context.Background(), "GET", "http://a/items", nil, response)
+	require.Nil(t, err)
+	require.Equal(t, 200, response.Status)
+}
+
+func TestCallerDeadlineIsNotOurs(t *testing.T) {
+	aulogging.SetupNoLoggerForTesting()
+
+	cut := New(&slowClient{delay: time.Second}, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := cut.Perform(ctx, "GET", "http://a/items", nil, &aurestclientapi.ParsedResponse{})
+	require.False(t, IsTimeout(err))
+	require.Equal(t, context.DeadlineExceeded, err)
+}